@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 
 	"github.com/nesbyte/loadr"
 )
@@ -13,9 +12,12 @@ import (
 //go:embed "*"
 var baseFS embed.FS
 
-// By default (production), use the embedded file system
+// By default (production), use the embedded file system.
+// While live reloading the templates are read from the SourceDir on disk instead,
+// which is the directory the FS is embedded from.
 var config = loadr.BaseConfig{
-	FS: baseFS,
+	FS:        baseFS,
+	SourceDir: ".",
 }
 
 type baseData struct {
@@ -74,18 +76,11 @@ func main() {
 	liveReload := false
 	if liveReload {
 
-		// In dev, use the os filesystem instead of the embedded one
-		// to allow for live reloads to take place
-		var config = loadr.BaseConfig{
-			FS: os.DirFS("."),
-		}
-		base.SetConfig(config) // resetting the config is ok!
-
 		// Live reload takes in the pattern of which the HTTP server will listen on (/live-reload)
 		// and allows some insertion of custom logic of what to do if a file has changed.
 		// HandleReload is a default setup that simply prints out reloaded files or errors
-		// pathsToWatch will recursively watch all files and folders inside itself
-		lsHandler, lsClose, err := loadr.RunLiveReload("/live-reload", loadr.HandleReload, ".")
+		// The SourceDir of the config is watched recursively, further pathsToWatch can be added
+		lsHandler, lsClose, err := loadr.RunLiveReload("/live-reload", loadr.HandleReload)
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -1,15 +1,30 @@
 package core
 
 import (
+	"context"
 	"html/template"
 	"io/fs"
+	"maps"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nesbyte/loadr/registry"
 )
 
 func NewTemplateContext[T any](baseConfig BaseConfig, baseData T, basePatterns ...string) *TemplateContext[T] {
+	bd := &baseDataStore[T]{}
+	bd.p.Store(&baseData)
+	baseConfig.addSourceDir()
+
 	return &TemplateContext[T]{
 		config:        &baseConfig,
-		baseData:      &baseData,
-		baseTemplates: basePatterns}
+		baseData:      bd,
+		baseTemplates: basePatterns,
+		registry:      registry.Default(),
+		onLoad:        &onLoadHook[T]{},
+		base:          &parseCache{},
+		parsed:        &parseCache{}}
 }
 
 // The Base render is the main data structure
@@ -17,11 +32,17 @@ func NewTemplateContext[T any](baseConfig BaseConfig, baseData T, basePatterns .
 // composition.
 type TemplateContext[T any] struct {
 	config        *BaseConfig
-	baseData      *T
-	baseTemplates []string // The base templates that are used and settable
+	baseData      *baseDataStore[T] // Shared with copies
+	baseTemplates []string          // The base templates that are used and settable
 	withTemplates []string
-	onLoad        func() error     // If set, called before the templates are loaded
-	funcMap       template.FuncMap // Functions that will be added to the templates
+	onLoad        *onLoadHook[T] // Called once per load cycle before the templates are loaded, shared with copies until set
+	funcLayers    []funcLayer    // Functions that will be added to the templates, shared with copies
+	textTemplate  bool           // If set, text/template is used instead of html/template
+	contextFuncs  map[string]ContextFunc
+	buffered      bool // If set, the output is only written after a successful execution
+	registry      *registry.Registry
+	base          *parseCache // Parsed base templates, shared with copies until the base changes
+	parsed        *parseCache // Parsed base and with templates of this TemplateContext
 }
 
 // Performs a shallow copy equivalent of TemplateContext
@@ -29,25 +50,137 @@ type TemplateContext[T any] struct {
 // are cloned to allow for overriding the templates
 // without changing the original TemplateContext.
 //
-// Changes in the Config and BaseData will propegate
-// to the copied TemplateContext.
+// Changes in the BaseData will propegate to the TemplateContext
+// and all its copies.
 func (tc *TemplateContext[T]) Copy(patterns ...string) *TemplateContext[T] {
 	bt := append([]string(nil), tc.baseTemplates...)
 	at := append([]string(nil), tc.withTemplates...)
 	newTemplateContext := TemplateContext[T]{
 		config:        tc.config,
 		baseData:      tc.baseData,
+		onLoad:        tc.onLoad,
 		baseTemplates: bt,
 		withTemplates: at,
-		funcMap:       tc.funcMap,
+		funcLayers:    tc.funcLayers,
+		textTemplate:  tc.textTemplate,
+		contextFuncs:  tc.contextFuncs,
+		buffered:      tc.buffered,
+		registry:      tc.registry,
+		base:          tc.base,
+		parsed:        &parseCache{},
 	}
 
 	return &newTemplateContext
 
 }
 
+// Copies the TemplateContext with the fsys layered on top of its FS and
+// the layers it already has, see BaseConfig.Layers. This allows overriding
+// some of the templates, such as for a theme or a tenant, while sharing the rest.
+func (tc *TemplateContext[T]) WithLayer(fsys fs.FS) *TemplateContext[T] {
+	config := *tc.config
+	config.Layers = append([]fs.FS{fsys}, tc.config.Layers...)
+
+	tcc := tc.Copy()
+	tcc.config = &config
+	tcc.resetParsed()
+	return tcc
+}
+
+// Detaches the TemplateContext from the parsed base templates shared
+// with its copies, as the base templates are no longer the same
+func (tc *TemplateContext[T]) resetParsed() {
+	tc.base = &parseCache{}
+	tc.parsed = &parseCache{}
+}
+
+// The base template patterns followed by the with template patterns
+func (tc *TemplateContext[T]) patterns() []string {
+	patterns := []string{}
+	patterns = append(patterns, tc.baseTemplates...)
+	patterns = append(patterns, tc.withTemplates...)
+	return patterns
+}
+
 type BaseConfig struct {
 	FS fs.FS // Sets the FS of the renderer, us fs.Sub to specify root of the FS
+
+	// The directory on disk the FS is built from, such as the directory of an embed.FS.
+	// While live reloading the templates are read from it instead of the FS and
+	// it is watched by the live reloader, which has to be started after the
+	// config is set. On the first load both must contain the same template files.
+	SourceDir string
+
+	// FSes layered on top of the FS, such as theme or tenant overrides.
+	// Every file is read from the first layer which has it, falling back to the FS.
+	Layers []fs.FS
+
+	// If set, a file found in several layers is parsed from each of them starting
+	// with the FS, so an override only has to contain the define blocks it replaces
+	MergeDefines bool
+}
+
+// The FS the templates are read from, the SourceDir while live reloading
+// with the Layers on top
+func (c *BaseConfig) fsys() fs.FS {
+	if len(c.Layers) == 0 {
+		return c.baseFS()
+	}
+	return layeredFS(c.layers())
+}
+
+func (c *BaseConfig) baseFS() fs.FS {
+	if c.SourceDir != "" && registry.LiveReload() {
+		return os.DirFS(c.SourceDir)
+	}
+	return c.FS
+}
+
+// The Layers followed by the base FS
+func (c *BaseConfig) layers() []fs.FS {
+	layers := append([]fs.FS(nil), c.Layers...)
+	if base := c.baseFS(); base != nil {
+		layers = append(layers, base)
+	}
+	return layers
+}
+
+// The directories on disk the FS and the Layers are read from, nil if the
+// location of any of them is unknown. The FS is located by the SourceDir,
+// the others only if they are an os.DirFS.
+func (c *BaseConfig) dirs() []string {
+	dirs := []string{}
+	for _, layer := range c.Layers {
+		dir, ok := dirFSRoot(layer)
+		if !ok {
+			return nil
+		}
+		dirs = append(dirs, dir)
+	}
+
+	dir, ok := c.SourceDir, c.SourceDir != ""
+	if !ok {
+		dir, ok = dirFSRoot(c.FS)
+	}
+	if !ok {
+		return nil
+	}
+	return append(dirs, dir)
+}
+
+// Parses the patterns from the FS, or from every layer if MergeDefines is set
+func (c *BaseConfig) parse(e executor, patterns ...string) (executor, error) {
+	if c.MergeDefines && len(c.Layers) > 0 {
+		return parseLayers(e, c.layers(), patterns...)
+	}
+	return parseFS(e, c.fsys(), patterns...)
+}
+
+// Registers the SourceDir to be watched by the live reloader
+func (c *BaseConfig) addSourceDir() {
+	if c.SourceDir != "" {
+		registry.AddSourceDir(c.SourceDir)
+	}
 }
 
 // Sets the configuration of the BaseTemplates
@@ -55,6 +188,8 @@ type BaseConfig struct {
 // base render, the last call is used
 func (tc *TemplateContext[T]) SetConfig(config BaseConfig) *TemplateContext[T] {
 	tc.config = &config
+	tc.config.addSourceDir()
+	tc.resetParsed()
 	return tc
 }
 
@@ -62,25 +197,91 @@ func (tc TemplateContext[T]) Config() BaseConfig {
 	return *tc.config
 }
 
+// Binds the TemplateContext to the registry, templates created with
+// NewTemplate afterwards are added to it instead of the default registry.
+// Copies made after this call inherit the registry.
+func (tc *TemplateContext[T]) SetRegistry(r *registry.Registry) *TemplateContext[T] {
+	tc.registry = r
+	tc.resetParsed() // The base templates include the funcs of the registry
+	return tc
+}
+
 // Sets the data which will be passed in on every
 // Render() call.
 // If SetBaseData is called multiple times on the same TemplateContext, the last
 // call is used.
 // This works immediately and independently from calling loadr.LoadTemplates()
+//
+// The base data is shared with all copies of the TemplateContext and is safe
+// to set concurrently with Render, every render uses either the previous or
+// the new base data in full. The data must not be modified after it has been
+// set, as renders may still be reading it, use UpdateBaseData instead.
 func (tc *TemplateContext[T]) SetBaseData(data T) *TemplateContext[T] {
-	tc.baseData = &data
+	tc.baseData.set(data)
+	return tc
+}
+
+// Replaces the base data with the result of update which is passed
+// the current base data. Concurrent updates are applied one at a time
+// so no update is lost, see SetBaseData for the concurrency contract.
+//
+// update must not call SetBaseData or UpdateBaseData.
+func (tc *TemplateContext[T]) UpdateBaseData(update func(data T) T) *TemplateContext[T] {
+	tc.baseData.update(update)
 	return tc
 }
 
+// Holds the base data of a TemplateContext and its copies,
+// reads are lock free while writes are serialised
+type baseDataStore[T any] struct {
+	mu sync.Mutex
+	p  atomic.Pointer[T]
+}
+
+func (s *baseDataStore[T]) load() T {
+	return *s.p.Load()
+}
+
+func (s *baseDataStore[T]) set(data T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.p.Store(&data)
+}
+
+// The current base data, to be passed to compareAndSet
+func (s *baseDataStore[T]) snapshot() *T {
+	return s.p.Load()
+}
+
+// Sets the data unless the base data has been set since the snapshot was taken,
+// so the updates made in the meantime are not lost
+func (s *baseDataStore[T]) compareAndSet(snapshot *T, data T) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.p.CompareAndSwap(snapshot, &data)
+}
+
+func (s *baseDataStore[T]) update(update func(T) T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data := update(*s.p.Load())
+	s.p.Store(&data)
+}
+
 // Sets all the templates to be parsed
 // SetTemplates overwrites previous SetTemplates calls
 func (tc *TemplateContext[T]) SetBaseTemplates(patterns ...string) *TemplateContext[T] {
 	tc.baseTemplates = patterns
+	tc.resetParsed()
 	return tc
 }
 
 func (tc *TemplateContext[T]) SetWithTemplates(patterns ...string) *TemplateContext[T] {
 	tc.withTemplates = patterns
+	tc.parsed = &parseCache{}
 	return tc
 }
 
@@ -99,19 +300,145 @@ func (tc *TemplateContext[T]) WT(patterns ...string) *TemplateContext[T] {
 	return tc.WithTemplates(patterns...)
 }
 
-// Sets the onLoad function which will be called
-// before every template (using NewTemplate and loadr.Load()) is loaded.
+// Sets the onLoad function which will be called once per
+// loadr.LoadTemplates() call (or live reload) before the templates are loaded.
+// The function is shared with the copies of the TemplateContext made afterwards
+// and runs only once for all of them, if it fails every template of the
+// TemplateContext and those copies fails to load with the error.
+// Setting it on a copy does not change the TemplateContext it was copied from.
+//
 // As an example, cache busting logic can be implemented here from manifest files
-// and then passed in to the tempaltes using SetBaseTemplates()
+// and then passed in to the tempaltes using SetBaseData()
 func (tc *TemplateContext[T]) SetOnTemplateLoad(onLoad func() error) {
-	// Currently inefficient as it is run every time on load
-	// if there are many templates it runs multiple times
-	tc.onLoad = onLoad
+	// Replaced rather than modified, as the hook is shared with the copies
+	tc.onLoad = &onLoadHook[T]{fn: func(data T) (T, error) {
+		return data, onLoad()
+	}}
+}
+
+// The same as SetOnTemplateLoad but the base data returned by onLoad
+// replaces the current base data before the templates are validated.
+// If the base data is set while onLoad runs, the base data set is kept instead.
+func (tc *TemplateContext[T]) SetOnTemplateLoadData(onLoad func(baseData T) (T, error)) {
+	tc.onLoad = &onLoadHook[T]{fn: onLoad, setsData: true}
+}
+
+// Runs the onLoad function of a TemplateContext and its copies
+// at most once per load cycle
+type onLoadHook[T any] struct {
+	mu       sync.Mutex
+	fn       func(T) (T, error)
+	setsData bool // If set, the result of fn replaces the base data
+	ran      bool
+	cycle    uint64
+	snapshot *T // The base data fn was passed
+	data     T
+	err      error
+}
+
+// The base data produced by a hook and the base data it replaces
+type onLoadResult[T any] struct {
+	data     T
+	snapshot *T
+}
+
+// Sets the base data unless it was set since the hook ran
+func (r *onLoadResult[T]) apply(baseData *baseDataStore[T]) {
+	baseData.compareAndSet(r.snapshot, r.data)
+}
+
+// Runs the hook unless it has already run within the cycle, in which
+// case the result of that run is returned.
+//
+// The returned base data is the one to validate the templates with.
+// The result is nil if there is no hook or it does not set the base data,
+// otherwise it has been applied if apply is set.
+func (h *onLoadHook[T]) run(cycle uint64, baseData *baseDataStore[T], apply bool) (data T, result *onLoadResult[T], err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.fn == nil {
+		return baseData.load(), nil, nil
+	}
+	if !h.ran || h.cycle != cycle {
+		h.snapshot = baseData.snapshot()
+		h.data, h.err = h.fn(*h.snapshot)
+		if h.err == nil && apply && h.setsData {
+			baseData.compareAndSet(h.snapshot, h.data)
+		}
+
+		h.ran = true
+		h.cycle = cycle
+	}
+
+	if !h.setsData {
+		return baseData.load(), nil, h.err
+	}
+	return h.data, &onLoadResult[T]{h.data, h.snapshot}, h.err
 }
 
 // Adds the FuncMap functions to the template context using the
-// std template.FuncMap type
+// std template.FuncMap type.
+//
+// The functions are merged with the ones added before, including those of the
+// TemplateContext it was copied from and of the registry, without modifying them.
+// Adding a different function of a name which already exists, including a closure
+// of the same function literal, makes the templates fail to load with an
+// ErrFuncConflict, use OverrideFuncs instead.
 func (tc *TemplateContext[T]) Funcs(funcMap template.FuncMap) *TemplateContext[T] {
-	tc.funcMap = funcMap
+	return tc.addFuncs(funcMap, false)
+}
+
+// The same as Funcs but replaces the existing functions of the same name
+func (tc *TemplateContext[T]) OverrideFuncs(funcMap template.FuncMap) *TemplateContext[T] {
+	return tc.addFuncs(funcMap, true)
+}
+
+func (tc *TemplateContext[T]) addFuncs(funcMap template.FuncMap, override bool) *TemplateContext[T] {
+	// Copied on write, as the layers are shared with the copies
+	layers := append([]funcLayer(nil), tc.funcLayers...)
+	tc.funcLayers = append(layers, funcLayer{maps.Clone(funcMap), override})
+	tc.resetParsed()
+	return tc
+}
+
+// Sets the templates to be parsed with text/template instead of html/template.
+//
+// By default html/template is used which contextually escapes the data
+// in HTML, attributes, URLs, JS and CSS. Only enable this for non-HTML output
+// such as plain-text emails, as no escaping takes place.
+// Copies made after this call inherit the setting.
+func (tc *TemplateContext[T]) SetTextTemplate(enabled bool) *TemplateContext[T] {
+	tc.textTemplate = enabled
+	tc.resetParsed()
+	return tc
+}
+
+// Derives a request-scoped value, such as a CSRF token or the current user,
+// from the context passed in to Templ.RenderCtx
+type ContextFunc func(ctx context.Context) any
+
+// Sets the ContextFuncs which are made available to the templates through
+// {{.Ctx "name"}} using the context passed in to RenderCtx.
+//
+// The ContextFuncs are also called with context.Background() when the templates
+// are validated and on Render/RenderE, so they should handle missing values.
+func (tc *TemplateContext[T]) ContextFuncs(funcs map[string]ContextFunc) *TemplateContext[T] {
+	tc.contextFuncs = funcs
+	return tc
+}
+
+// Sets the templates to be rendered into a pooled buffer which is
+// only written to the writer once the execution has succeeded.
+//
+// This guarantees that no partial output reaches the client if rendering fails,
+// allowing a proper error page to be sent instead, at the cost of holding
+// the whole output in memory.
+// When live reloading is enabled the output is always buffered.
+//
+// If writing the output fails once the execution has succeeded, RenderE returns
+// the error of the writer as it is rather than an *ExecutionError, and Render ignores it.
+func (tc *TemplateContext[T]) SetBuffered(enabled bool) *TemplateContext[T] {
+	tc.buffered = enabled
 	return tc
 }
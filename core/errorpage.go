@@ -0,0 +1,86 @@
+package core
+
+import (
+	"html/template"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/nesbyte/loadr/livereload"
+	"github.com/nesbyte/loadr/registry"
+)
+
+// Number of lines shown before and after the offending line
+const snippetContext = 3
+
+// Builds the live reload error page for a template which failed to load
+func newErrorPage[T, U any](t *Templ[T, U], err error) livereload.ErrorPage {
+	page := livereload.ErrorPage{
+		Err: err,
+		JS:  template.HTML(registry.JSToInject()),
+	}
+
+	loc := errLocation(err)
+	if loc.Template == "" || t.tc.config == nil {
+		return page
+	}
+	fsys := t.tc.config.fsys()
+	if fsys == nil {
+		return page
+	}
+	page.Line = loc.Line
+	page.Column = loc.Column
+	page.File = loc.Template
+
+	file, ok := findFile(fsys, loc.Template, t.tc.patterns())
+	if !ok {
+		return page
+	}
+	page.File = file
+
+	bs, err := fs.ReadFile(fsys, file)
+	if err != nil {
+		return page
+	}
+	page.Snippet = snippet(string(bs), loc.Line)
+
+	return page
+}
+
+// Finds the file matched by the patterns which was parsed as the template name.
+// Templates parsed from files are named after the base name of the file.
+func findFile(fsys fs.FS, name string, patterns []string) (string, bool) {
+	for _, pattern := range patterns {
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			continue
+		}
+		for _, m := range matches {
+			if path.Base(m) == name {
+				return m, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Returns the lines surrounding line
+func snippet(src string, line int) []livereload.SnippetLine {
+	lines := strings.Split(strings.TrimSuffix(src, "\n"), "\n")
+	if line < 1 || line > len(lines) {
+		return nil
+	}
+
+	start := max(line-snippetContext, 1)
+	end := min(line+snippetContext, len(lines))
+
+	s := make([]livereload.SnippetLine, 0, end-start+1)
+	for n := start; n <= end; n++ {
+		s = append(s, livereload.SnippetLine{
+			Number: n,
+			Text:   strings.TrimRight(lines[n-1], "\r"),
+			Error:  n == line,
+		})
+	}
+	return s
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// The functions of a single Funcs or OverrideFuncs call
+type funcLayer struct {
+	funcs    template.FuncMap
+	override bool
+}
+
+// The functions of the registry followed by those of the TemplateContext
+func (tc *TemplateContext[T]) funcs() (template.FuncMap, error) {
+	layers := []funcLayer{}
+	for _, funcs := range tc.registry.FuncMaps() {
+		layers = append(layers, funcLayer{funcs: funcs})
+	}
+	layers = append(layers, tc.funcLayers...)
+
+	return mergeFuncs(layers)
+}
+
+// Merges the layers in order. A function replacing a different one of
+// the same name is an ErrFuncConflict unless its layer overrides.
+func mergeFuncs(layers []funcLayer) (template.FuncMap, error) {
+	merged := template.FuncMap{}
+	var errs []error
+
+	for _, layer := range layers {
+		names := make([]string, 0, len(layer.funcs))
+		for name := range layer.funcs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fn := layer.funcs[name]
+			if existing, ok := merged[name]; ok && !layer.override && !sameFunc(existing, fn) {
+				errs = append(errs, fmt.Errorf("%w: %s", ErrFuncConflict, name))
+			}
+			merged[name] = fn
+		}
+	}
+
+	return merged, errors.Join(errs...)
+}
+
+// Matches the names of the closures, such as "pkg.outer.func1" or "pkg.outer.func1.2"
+var closureName = regexp.MustCompile(`\.func\d+(\.\d+)*$`)
+
+// Reports whether both are the same top level function. Closures of the same
+// function literal and method values share their code but not what they
+// capture, so they are never the same.
+func sameFunc(a, b any) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Kind() != reflect.Func || vb.Kind() != reflect.Func || va.Pointer() != vb.Pointer() {
+		return false
+	}
+
+	fn := runtime.FuncForPC(va.Pointer())
+	if fn == nil {
+		return false
+	}
+	name := fn.Name()
+	return !closureName.MatchString(name) && !strings.HasSuffix(name, "-fm")
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"path"
+	"sort"
+	texttemplate "text/template"
+)
+
+// FSes layered on top of each other, a file is read from the first
+// layer which has it while directories list the entries of all the layers
+type layeredFS []fs.FS
+
+func (l layeredFS) Open(name string) (fs.File, error) {
+	for _, fsys := range l {
+		f, err := fsys.Open(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		return f, err
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (l layeredFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	found := false
+	seen := make(map[string]bool)
+	entries := []fs.DirEntry{}
+
+	for _, fsys := range l {
+		layerEntries, err := fs.ReadDir(fsys, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		found = true
+		for _, entry := range layerEntries {
+			if !seen[entry.Name()] {
+				seen[entry.Name()] = true
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Parses the files matched by the patterns from every layer which has them,
+// starting with the bottom layer, so that the define blocks of the upper
+// layers replace the ones of the lower layers.
+//
+// A file in an upper layer which only contains define blocks keeps the
+// body of the file below, as empty templates do not replace existing ones.
+func parseLayers(e executor, layers []fs.FS, patterns ...string) (executor, error) {
+	if len(patterns) == 0 {
+		return e, nil
+	}
+
+	files := []string{}
+	for _, pattern := range patterns {
+		matches, err := fs.Glob(layeredFS(layers), pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("template: pattern matches no files: %#q", pattern)
+		}
+		files = append(files, matches...)
+	}
+
+	for _, file := range files {
+		for i := len(layers) - 1; i >= 0; i-- {
+			b, err := fs.ReadFile(layers[i], file)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			e, err = parseText(e, path.Base(file), string(b))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return e, nil
+}
+
+// Parses the text as the named template of the set
+func parseText(e executor, name, text string) (executor, error) {
+	switch t := e.(type) {
+	case *texttemplate.Template:
+		_, err := t.New(name).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	case *template.Template:
+		_, err := t.New(name).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("unsupported template type %T", e)
+}
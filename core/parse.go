@@ -0,0 +1,258 @@
+package core
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+)
+
+// The parsed template set, satisfied by both the html/template
+// and text/template packages
+type executor interface {
+	ExecuteTemplate(w io.Writer, name string, data any) error
+}
+
+// Creates an empty template set using html/template unless
+// text is set in which case text/template is used instead
+func newTemplates(text bool, funcMap template.FuncMap) executor {
+	if text {
+		return texttemplate.New("").Funcs(funcMap)
+	}
+	return template.New("").Funcs(funcMap)
+}
+
+// Parses the patterns from the FS into the template set
+func parseFS(e executor, fsys fs.FS, patterns ...string) (executor, error) {
+	if len(patterns) == 0 {
+		return e, nil
+	}
+
+	switch t := e.(type) {
+	case *texttemplate.Template:
+		t, err := t.ParseFS(fsys, patterns...)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	case *template.Template:
+		t, err := t.ParseFS(fsys, patterns...)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("unsupported template type %T", e)
+}
+
+// Clones the parsed template set so it can be executed
+// independently of the original
+func clone(e executor) (executor, error) {
+	switch t := e.(type) {
+	case *texttemplate.Template:
+		c, err := t.Clone()
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case *template.Template:
+		c, err := t.Clone()
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("unsupported template type %T", e)
+}
+
+// Caches parsed templates within a load cycle so that the parse work
+// is shared. The cached set is never executed, only clones of it are.
+type parseCache struct {
+	mu    sync.Mutex
+	valid bool
+	cycle uint64
+	t     executor
+	err   error
+}
+
+// Returns a clone of the cached templates, calling parse
+// if they have not been parsed within the cycle
+func (c *parseCache) get(cycle uint64, parse func() (executor, error)) (executor, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.valid || c.cycle != cycle {
+		c.t, c.err = parse()
+		c.valid = true
+		c.cycle = cycle
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return clone(c.t)
+}
+
+// Parses the patterns of the TemplateContext.
+//
+// The base templates are parsed once per cycle and shared with all the
+// TemplateContexts copied from it, each context then clones them and parses
+// only its with templates on top, which in turn is shared by all templates
+// of the context.
+func (tc *TemplateContext[T]) parse(cycle uint64) (executor, error) {
+	return tc.parsed.get(cycle, func() (executor, error) {
+		base, err := tc.base.get(cycle, func() (executor, error) {
+			// Conflicts are reported by the load before parsing
+			funcs, _ := tc.funcs()
+			return tc.config.parse(newTemplates(tc.textTemplate, funcs), tc.baseTemplates...)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return tc.config.parse(base, tc.withTemplates...)
+	})
+}
+
+// Returns the files in the FS matched by the patterns. As {{template}} calls
+// can only refer to templates parsed together, these are all the files
+// the templates depend on.
+func matchFiles(fsys fs.FS, patterns []string) []string {
+	files := []string{}
+	for _, pattern := range patterns {
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			continue
+		}
+		files = append(files, matches...)
+	}
+	return files
+}
+
+// Compares the template files matched by the patterns in the FS and the
+// source directory, returning an ErrSourceMismatch listing the differences
+func compareFiles(fsys fs.FS, sourceDir string, patterns []string) error {
+	inFS := matchFiles(fsys, patterns)
+	inSource := matchFiles(os.DirFS(sourceDir), patterns)
+
+	var details []string
+	if missing := missingFiles(inFS, inSource); len(missing) > 0 {
+		details = append(details, fmt.Sprintf("missing in %s: %s", sourceDir, strings.Join(missing, ", ")))
+	}
+	if missing := missingFiles(inSource, inFS); len(missing) > 0 {
+		details = append(details, fmt.Sprintf("missing in the FS: %s", strings.Join(missing, ", ")))
+	}
+
+	if len(details) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrSourceMismatch, strings.Join(details, "; "))
+}
+
+// The sorted files which are not in other
+func missingFiles(files, other []string) []string {
+	in := make(map[string]bool, len(other))
+	for _, f := range other {
+		in[f] = true
+	}
+
+	var missing []string
+	for _, f := range files {
+		if !in[f] {
+			in[f] = true // Patterns can match the same file more than once
+			missing = append(missing, f)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// Reports whether the changed file path, as reported by the file watcher,
+// refers to one of the FS files or could be matched by one of the patterns.
+//
+// The changed path is resolved against the dirs the FS is read from on disk.
+// If they are unknown, the FS paths are matched against the end of the changed path.
+func dependsOn(changed string, dirs []string, files []string, patterns []string) bool {
+	if len(dirs) > 0 {
+		for _, dir := range dirs {
+			rel, ok := relPath(dir, changed)
+			if ok && matches(rel, files, patterns) {
+				return true
+			}
+		}
+		return false
+	}
+
+	changed = filepath.ToSlash(filepath.Clean(changed))
+	segments := strings.Split(changed, "/")
+
+	for _, f := range files {
+		if changed == f || strings.HasSuffix(changed, "/"+f) {
+			return true
+		}
+	}
+
+	// Newly created files matching the patterns have not been parsed yet
+	for _, p := range patterns {
+		n := strings.Count(p, "/") + 1
+		if n > len(segments) {
+			continue
+		}
+		ok, _ := path.Match(p, strings.Join(segments[len(segments)-n:], "/"))
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The slash separated path of name relative to dir, false if it is not inside dir
+func relPath(dir, name string) (string, bool) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	absName, err := filepath.Abs(name)
+	if err != nil {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(absDir, absName)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// Reports whether the FS path is one of the files or matched by one of the patterns
+func matches(name string, files []string, patterns []string) bool {
+	for _, f := range files {
+		if name == f {
+			return true
+		}
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// The directory on disk of an os.DirFS, which does not expose it otherwise
+func dirFSRoot(fsys fs.FS) (string, bool) {
+	t := reflect.TypeOf(fsys)
+	if t == nil || t.PkgPath() != "os" || t.Name() != "dirFS" || t.Kind() != reflect.String {
+		return "", false
+	}
+	return reflect.ValueOf(fsys).String(), true
+}
@@ -2,11 +2,15 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"regexp"
+	"strconv"
 	"strings"
-	"text/template"
+	"sync"
+	"sync/atomic"
 
 	"github.com/nesbyte/loadr/livereload"
 	"github.com/nesbyte/loadr/registry"
@@ -15,18 +19,28 @@ import (
 func NewTemplate[T, U any](tc *TemplateContext[T], pattern string, data U) *Templ[T, U] {
 	t := Templ[T, U]{tc: tc, data: data, usePattern: pattern}
 
-	registry.Add(&t)
+	tc.registry.Add(&t)
 
 	return &t
 }
 
 type Templ[T, U any] struct {
-	t          *template.Template
+	t          atomic.Pointer[loadedTemplates] // Only set once the templates have been validated
+	files      atomic.Pointer[[]string]        // The files the last load was parsed from
+	sourceOK   atomic.Bool                     // Set once the SourceDir has been checked against the FS
 	tc         *TemplateContext[T]
 	data       U
 	usePattern string
 }
 
+// The validated templates of a Templ, swapped atomically on load
+// so that renders always use a consistent, validated template
+// while the template is being reloaded
+type loadedTemplates struct {
+	t   executor // The last successfully validated templates, nil if never loaded
+	err error    // Set if the last load failed
+}
+
 var ErrNoBaseOrPatternFound = errors.New("no basetemplate nor patterns have been provided")
 
 type LoadingError struct {
@@ -48,58 +62,249 @@ func newLoadingError[T, U any](t *Templ[T, U], err error) error {
 	return &LoadingError{t.tc.baseTemplates, t.tc.withTemplates, t.usePattern, err}
 }
 
+// The location of a failing template action as reported by the template packages
+type Location struct {
+	Template string // The name of the template, for templates parsed from files this is the file name
+	Line     int
+	Column   int // Zero if not reported
+}
+
+func (l Location) String() string {
+	if l.Column == 0 {
+		return fmt.Sprintf("%s:%d", l.Template, l.Line)
+	}
+	return fmt.Sprintf("%s:%d:%d", l.Template, l.Line, l.Column)
+}
+
+// Matches both "template: name:line:col:" and "html/template:name:line:col:"
+var locationRegexp = regexp.MustCompile(`template:\s?([^:\s]+):(\d+)(?::(\d+))?:`)
+
+// Extracts the location from a template error, the zero Location
+// is returned if none could be found
+func errLocation(err error) Location {
+	m := locationRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return Location{}
+	}
+
+	l := Location{Template: m[1]}
+	l.Line, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		l.Column, _ = strconv.Atoi(m[3])
+	}
+	return l
+}
+
+// Returned when a loaded template fails to execute during rendering,
+// for example when a FuncMap function returns an error
+type ExecutionError struct {
+	BaseTemplates []string
+	WithTemplates []string
+	UsePattern    string
+	Location      Location // Location of the failing action, zero if unknown
+	Err           error
+}
+
+func (e *ExecutionError) Error() string {
+	if e.Location == (Location{}) {
+		return fmt.Sprintf("basetemplates %q with templates %q and template pattern %q failed to execute: %s", e.BaseTemplates, strings.Join(e.WithTemplates, ", "), e.UsePattern, e.Err.Error())
+	}
+	return fmt.Sprintf("basetemplates %q with templates %q and template pattern %q failed to execute at %s: %s", e.BaseTemplates, strings.Join(e.WithTemplates, ", "), e.UsePattern, e.Location, e.Err.Error())
+}
+
+func (e *ExecutionError) Unwrap() error {
+	return e.Err
+}
+
+func newExecutionError[T, U any](t *Templ[T, U], err error) error {
+	return &ExecutionError{t.tc.baseTemplates, t.tc.withTemplates, t.usePattern, errLocation(err), err}
+}
+
 var ErrNoConfigProvided = errors.New("no config provided")
 var ErrTemplateParse = errors.New("template parse error")
 var ErrInvalidTemplateData = errors.New("invalid template data")
+var ErrSourceMismatch = errors.New("the source directory and the FS contain different template files")
+var ErrFuncConflict = errors.New("template func added more than once with different implementations")
+var ErrNotLoaded = errors.New("template has not been loaded, has loadr.LoadTemplates() been called?")
 
 // Base data used to define the data passed in to the
 // template
 type BaseData[T any, U any] struct {
 	B T // BaseData passed in on every Render() call
 	D U // Data passed in explicitly by the Render(data) call
+
+	ctx          context.Context
+	contextFuncs map[string]ContextFunc
+}
+
+var ErrUnknownContextFunc = errors.New("unknown context func")
+
+// Returns the request-scoped value of the ContextFunc registered under name
+// using the context passed in to RenderCtx.
+// In the template it is used as:
+//
+//	{{.Ctx "csrf"}}
+func (b BaseData[T, U]) Ctx(name string) (any, error) {
+	f, ok := b.contextFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownContextFunc, name)
+	}
+
+	ctx := b.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return f(ctx), nil
+}
+
+// Aborts the template execution on the next write
+// once the context is cancelled
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+	err error // The last error of w, to tell it apart from the execution errors
+}
+
+func (cw *ctxWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := cw.w.Write(p)
+	if err != nil {
+		cw.err = err
+	}
+	return n, err
 }
 
 // Loads, validates and registers the template.
 // This should rarely be called directly
+//
+// Every call starts a new load cycle, so the files are parsed again and the
+// onLoad function is run again.
+// The validated template is swapped in atomically, if loading fails the
+// previously loaded template is kept and used for rendering.
 func (t *Templ[T, U]) Load() error {
-	// Immeditately run on load
-	if t.tc.onLoad != nil {
-		err := t.tc.onLoad()
-		if err != nil {
-			return err
+	return t.LoadCycle(t.tc.registry.NewCycle())
+}
+
+// The same as Load but within the load cycle of the registry, templates of
+// the same TemplateContext share the parsed templates within a cycle.
+// See registry.CycleLoader.
+func (t *Templ[T, U]) LoadCycle(cycle uint64) error {
+	tmpl, _, err := t.load(cycle, true)
+
+	prev := t.t.Load()
+	if err != nil {
+		loaded := &loadedTemplates{err: err}
+		if prev != nil {
+			loaded.t = prev.t
 		}
+		t.t.Store(loaded)
+		return err
+	}
+
+	t.t.Store(&loadedTemplates{t: tmpl})
+	return nil
+}
+
+// Loads and validates the template within the load cycle without swapping it in,
+// the returned commit swaps it in along with the base data produced by the
+// onLoad function, unless the base data was set meanwhile, see registry.StagedLoader.
+// This should rarely be called directly
+func (t *Templ[T, U]) Stage(cycle uint64) (commit func(), err error) {
+	tmpl, result, err := t.load(cycle, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if result != nil {
+			result.apply(t.tc.baseData)
+		}
+		t.t.Store(&loadedTemplates{t: tmpl})
+	}, nil
+}
+
+// Parses and validates the template, returning the base data produced by the
+// onLoad function if there is one. The base data is only applied if apply is set.
+func (t *Templ[T, U]) load(cycle uint64, apply bool) (executor, *onLoadResult[T], error) {
+	// Immeditately run on load
+	baseData, result, err := t.tc.onLoad.run(cycle, t.tc.baseData, apply)
+	if err != nil {
+		return nil, nil, newLoadingError(t, err)
 	}
 
 	if t.tc.config == nil {
-		return ErrNoConfigProvided
+		return nil, nil, newLoadingError(t, ErrNoConfigProvided)
 	}
 
-	patterns := []string{}
-	patterns = append(patterns, t.tc.baseTemplates...)
-	patterns = append(patterns, t.tc.withTemplates...)
+	if len(t.tc.patterns()) == 0 {
+		return nil, nil, newLoadingError(t, ErrNoBaseOrPatternFound)
+	}
 
-	if len(patterns) == 0 {
-		return newLoadingError(t, ErrNoBaseOrPatternFound)
+	err = t.checkSourceDir()
+	if err != nil {
+		return nil, nil, newLoadingError(t, err)
 	}
 
+	_, err = t.tc.funcs()
+	if err != nil {
+		return nil, nil, newLoadingError(t, err)
+	}
+
+	// Tracked before parsing so a failed template reloads once fixed
+	files := matchFiles(t.tc.config.fsys(), t.tc.patterns())
+	t.files.Store(&files)
+
 	// Parse and cache the template
-	var err error
-	t.t, err = template.New("").Funcs(t.tc.funcMap).ParseFS(t.tc.config.FS, patterns...)
+	tmpl, err := t.tc.parse(cycle)
 	if err != nil {
-		return newLoadingError(t, fmt.Errorf("%w: %v", ErrTemplateParse, err))
+		return nil, nil, newLoadingError(t, fmt.Errorf("%w: %v", ErrTemplateParse, err))
 	}
 
 	// Try to execute the template using the sample data provided
 	bs := []byte{}
 	w := bytes.NewBuffer(bs)
-	err = t.t.ExecuteTemplate(w, t.usePattern, BaseData[T, U]{B: *t.tc.baseData, D: t.data})
+	err = tmpl.ExecuteTemplate(w, t.usePattern, BaseData[T, U]{B: baseData, D: t.data, contextFuncs: t.tc.contextFuncs})
+	if err != nil {
+		return nil, nil, newLoadingError(t, fmt.Errorf("%w has a .B or .D prefix been included for the field?: %v", ErrInvalidTemplateData, err))
+	}
+
+	return tmpl, result, nil
+}
+
+// Checks once while live reloading that the SourceDir contains the same
+// template files as the FS, as otherwise the templates being live reloaded
+// are not the ones which end up in the FS
+func (t *Templ[T, U]) checkSourceDir() error {
+	config := t.tc.config
+	if config.SourceDir == "" || config.FS == nil || !registry.LiveReload() || t.sourceOK.Load() {
+		return nil
+	}
+
+	err := compareFiles(config.FS, config.SourceDir, t.tc.patterns())
 	if err != nil {
-		return newLoadingError(t, fmt.Errorf("%w has a .B or .D prefix been included for the field?: %v", ErrInvalidTemplateData, err))
+		return err
 	}
 
+	t.sourceOK.Store(true)
 	return nil
 }
 
+// Reports whether the template has to be reloaded when the file
+// at the path has changed, see registry.DependencyLoader.
+//
+// The path is resolved against the SourceDir, or the directory of an os.DirFS,
+// otherwise the FS paths are matched against the end of the path.
+// Templates which have not been loaded yet always depend on the path.
+func (t *Templ[T, U]) DependsOn(path string) bool {
+	files := t.files.Load()
+	if files == nil {
+		return true
+	}
+	return dependsOn(path, t.tc.config.dirs(), *files, t.tc.patterns())
+}
+
 // Renders the template to a writer with the base data
 // and data of the loaded type.
 // The data injected into a struct is of the form:
@@ -113,33 +318,73 @@ func (t *Templ[T, U]) Load() error {
 // in the above form.
 //
 // If live reloading is enabled, JS is injected at the end of the body.
+//
+// Render panics with a *LoadingError wrapping the *ExecutionError if the
+// template fails to execute, use RenderE to handle the error instead.
+// The errors of the writer, such as a client which has disconnected, are ignored.
 func (t *Templ[T, U]) Render(w io.Writer, data U) {
-	d := BaseData[T, U]{B: *t.tc.baseData, D: data}
+	err := t.RenderE(w, data)
+
+	var execErr *ExecutionError
+	if errors.As(err, &execErr) {
+		panic(newLoadingError(t, execErr))
+	}
+}
+
+// The same as Render but returns an *ExecutionError instead of
+// panicking if the template fails to execute.
+// The errors of the writer are returned as they are.
+//
+// If live reloading is enabled and the last reload of the template failed,
+// the live reload error page is rendered instead, see livereload.SetErrorPage.
+func (t *Templ[T, U]) RenderE(w io.Writer, data U) error {
+	return t.RenderCtx(context.Background(), w, data)
+}
+
+// The same as RenderE but makes the request-scoped values of the
+// TemplateContext's ContextFuncs available to the template through .Ctx.
+//
+// The rendering is aborted and the context error returned
+// if the context is cancelled.
+func (t *Templ[T, U]) RenderCtx(ctx context.Context, w io.Writer, data U) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	d := BaseData[T, U]{B: t.tc.baseData.load(), D: data, ctx: ctx, contextFuncs: t.tc.contextFuncs}
+	loaded := t.t.Load()
 
 	// In production rendering is short and simple
 	if !registry.LiveReload() {
-		err := t.t.ExecuteTemplate(w, t.usePattern, d)
+		if !t.tc.buffered {
+			return t.execute(ctx, loaded, w, d)
+		}
+
+		buf := getBuffer()
+		defer putBuffer(buf)
+
+		err := t.execute(ctx, loaded, buf, d)
 		if err != nil {
-			panic(&LoadingError{t.tc.baseTemplates, t.tc.withTemplates, t.usePattern, fmt.Errorf("execute template error in render %s", err)})
+			return err
 		}
-		return
-	}
 
-	// Reload the component
-	err := t.Load()
-	if err != nil {
-		w.Write([]byte(registry.JSToInject()))
+		_, err = buf.WriteTo(w)
+		return err
+	}
 
-		livereload.LiveReloadCustomErrorHandler(err)
-		return
+	// The templates are reloaded by the live reload watcher,
+	// show the error page until the last reload succeeds
+	if loaded != nil && loaded.err != nil {
+		return livereload.RenderErrorPage(w, newErrorPage(t, loaded.err))
 	}
 
 	// Capture the output to a buffer
-	var buf bytes.Buffer
+	buf := getBuffer()
+	defer putBuffer(buf)
 
-	err = t.t.ExecuteTemplate(&buf, t.usePattern, d)
+	err := t.execute(ctx, loaded, buf, d)
 	if err != nil {
-		panic(&LoadingError{t.tc.baseTemplates, t.tc.withTemplates, t.usePattern, fmt.Errorf("execute template error in render %s", err)})
+		return err
 	}
 
 	html := buf.String()
@@ -148,5 +393,49 @@ func (t *Templ[T, U]) Render(w io.Writer, data U) {
 		html = html[:idx] + registry.JSToInject() + html[idx:]
 	}
 
-	w.Write([]byte(html))
+	_, err = w.Write([]byte(html))
+	return err
+}
+
+// Executes the template, returning the context error if the context
+// was cancelled during the execution and the writer error if it failed
+func (t *Templ[T, U]) execute(ctx context.Context, loaded *loadedTemplates, w io.Writer, d BaseData[T, U]) error {
+	if loaded == nil || loaded.t == nil {
+		return newExecutionError(t, ErrNotLoaded)
+	}
+
+	cw := &ctxWriter{ctx: ctx, w: w}
+	err := loaded.t.ExecuteTemplate(cw, t.usePattern, d)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if cw.err != nil && errors.Is(err, cw.err) {
+		return err
+	}
+	if err != nil {
+		return newExecutionError(t, err)
+	}
+	return nil
+}
+
+// Buffers larger than this are not returned to the pool
+// to avoid holding on to memory from unusually large renders
+const maxPooledBufferSize = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
 }
@@ -0,0 +1,55 @@
+package livereload
+
+import (
+	"html/template"
+	"io"
+	"sync"
+)
+
+// The data passed to the error page template when a template
+// fails to load while live reloading
+type ErrorPage struct {
+	Err     error
+	File    string // The path of the offending file in the FS, empty if unknown
+	Line    int    // Zero if unknown
+	Column  int    // Zero if unknown
+	Snippet []SnippetLine
+	JS      template.HTML // The live reload JS, must be included for the page to refresh once fixed
+}
+
+// A single source line surrounding the error
+type SnippetLine struct {
+	Number int
+	Text   string
+	Error  bool // Set on the line the error was reported on
+}
+
+var defaultErrorPage = template.Must(template.ParseFS(liveReloaderHTML, "errorPage.html"))
+
+var (
+	errorPageMu sync.RWMutex
+	errorPage   = defaultErrorPage
+)
+
+// Replaces the error page rendered when a template fails to load
+// while live reloading. The template is executed with an ErrorPage.
+//
+// If nil is provided, the default error page is restored.
+func SetErrorPage(t *template.Template) {
+	errorPageMu.Lock()
+	defer errorPageMu.Unlock()
+
+	if t == nil {
+		t = defaultErrorPage
+	}
+	errorPage = t
+}
+
+// Renders the error page, see SetErrorPage
+func RenderErrorPage(w io.Writer, page ErrorPage) error {
+	errorPageMu.RLock()
+	t := errorPage
+	errorPageMu.RUnlock()
+
+	return t.Execute(w, page)
+}
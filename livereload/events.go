@@ -0,0 +1,88 @@
+package livereload
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The live reload handler serves Server-Sent Events of the following types,
+// each with a JSON encoded Event as its data:
+//
+//	connected  sent once the client is connected
+//	reload     files have changed and the page should be reloaded
+//	css        only stylesheets have changed, listed in paths, and can be swapped in place
+//	error      the file watcher failed, see error
+//
+// Every event has an id of the form "<instance>-<sequence>" where the instance
+// identifies the running LiveReloader. Clients reconnecting with a Last-Event-ID
+// are sent the events they missed, or a reload if they cannot be resumed
+// such as after the server has restarted.
+//
+// Heartbeat comments are sent while idle to keep proxies from closing the connection.
+//
+// Over a WebSocket every event is a text message holding the JSON encoded
+// Event together with its "id" and "type", and pings are sent instead of
+// heartbeat comments. The last event id is passed as the lastEventId
+// query parameter when reconnecting.
+const (
+	EventConnected = "connected"
+	EventReload    = "reload"
+	EventCSS       = "css"
+	EventError     = "error"
+)
+
+// The events kept for clients resuming with a Last-Event-ID
+const eventHistorySize = 64
+
+// The interval heartbeat comments are sent at if not set in the Options
+const defaultHeartbeat = 15 * time.Second
+
+// Sent to the clients on every change
+type Event struct {
+	ID    string   `json:"-"`
+	Type  string   `json:"-"`
+	Paths []string `json:"paths,omitempty"` // The changed paths, using forward slashes
+	Error string   `json:"error,omitempty"` // Set if the watcher or the template reload failed
+}
+
+// Writes the event in the Server-Sent Events format
+func (e Event) write(w io.Writer) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+// Encodes the event including its id and type, for the WebSocket messages
+func (e Event) message() ([]byte, error) {
+	return json.Marshal(struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Event
+	}{e.ID, e.Type, e})
+}
+
+func eventID(instance string, seq uint64) string {
+	return instance + "-" + strconv.FormatUint(seq, 10)
+}
+
+// Splits a Last-Event-ID in to its instance and sequence
+func parseEventID(id string) (instance string, seq uint64, ok bool) {
+	i := strings.LastIndexByte(id, '-')
+	if i == -1 {
+		return "", 0, false
+	}
+
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return id[:i], seq, true
+}
@@ -0,0 +1,297 @@
+package livereload
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// How a change to a file is handled, see Options.Extensions
+type Action int
+
+const (
+	ActionReload Action = iota // The templates are reloaded and the page is reloaded
+	ActionCSS                  // The stylesheet is swapped in place if all the changes are stylesheets
+	ActionIgnore               // The change is ignored
+)
+
+// The actions used for the extensions not set in Options.Extensions
+var defaultActions = map[string]Action{
+	goType:  ActionIgnore, // Go files are not relevant for live reloading
+	cssType: ActionCSS,
+}
+
+// Decides which of the files and directories below the watched paths are watched.
+//
+// The patterns of Options.Include, Options.Exclude and the ignore files follow the
+// .gitignore syntax: a pattern without a slash matches the name at any depth,
+// one with a slash is relative to the watched path (or the ignore file),
+// a trailing slash only matches directories, "**" matches any number of
+// directories and a leading "!" re-includes what a previous pattern excluded.
+//
+// Files and directories whose name starts with a dot are always ignored,
+// this covers .git and most editor swap files.
+type filter struct {
+	roots   []string // The watched paths
+	include []rule
+	exclude []rule
+	actions map[string]Action
+}
+
+// A single .gitignore style pattern
+type rule struct {
+	dir      string // The directory the pattern is relative to, the watched path if empty
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+func newFilter(opts Options) (*filter, error) {
+	f := &filter{actions: make(map[string]Action)}
+
+	for _, root := range opts.PathsToWatch {
+		f.roots = append(f.roots, filepath.Clean(root))
+	}
+
+	for ext, action := range defaultActions {
+		f.actions[ext] = action
+	}
+	for ext, action := range opts.Extensions {
+		f.actions[strings.ToLower(ext)] = action
+	}
+
+	for _, pattern := range opts.Include {
+		r, ok, err := parseRule("", pattern)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			f.include = append(f.include, r)
+		}
+	}
+
+	for _, pattern := range opts.Exclude {
+		r, ok, err := parseRule("", pattern)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			f.exclude = append(f.exclude, r)
+		}
+	}
+
+	for _, name := range opts.IgnoreFiles {
+		rules, err := readIgnoreFile(name)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, rules...)
+	}
+
+	return f, nil
+}
+
+// Reads the patterns of a .gitignore style file, which are relative to its directory
+func readIgnoreFile(name string) ([]rule, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	dir := filepath.Dir(filepath.Clean(name))
+
+	var rules []rule
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		r, ok, err := parseRule(dir, scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		if ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// Parses the pattern, false is returned for blank lines and comments
+func parseRule(dir, pattern string) (rule, bool, error) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return rule{}, false, nil
+	}
+
+	r := rule{dir: dir}
+	if strings.HasPrefix(pattern, "!") {
+		r.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+
+	// Patterns without a slash match the name at any depth
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimLeft(pattern, "/")
+	if pattern == "" {
+		return rule{}, false, nil
+	}
+
+	r.segments = strings.Split(pattern, "/")
+	for _, segment := range r.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return rule{}, false, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	if !anchored {
+		r.segments = append([]string{"**"}, r.segments...)
+	}
+
+	return r, true, nil
+}
+
+// Matches the slash separated path relative to the directory of the rule
+func (r rule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	return matchSegments(r.segments, strings.Split(rel, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// A trailing "**" matches everything inside but not the directory itself
+			start := 0
+			if len(pattern) == 1 {
+				start = 1
+			}
+			for i := start; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// Returns the watched path containing the name, the deepest one if nested
+func (f *filter) root(name string) string {
+	root := ""
+	for _, r := range f.roots {
+		if within(r, name) && len(r) > len(root) {
+			root = r
+		}
+	}
+	return root
+}
+
+// Returns the slash separated path of name relative to dir,
+// false if name is not within dir
+func relative(dir, name string) (string, bool) {
+	rel, err := filepath.Rel(dir, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+func within(dir, name string) bool {
+	_, ok := relative(dir, name)
+	return ok
+}
+
+// Reports whether the file or directory should not be watched,
+// a file is also ignored if any of its parent directories are
+func (f *filter) ignored(name string, isDir bool) bool {
+	name = filepath.Clean(name)
+	root := f.root(name)
+
+	rel, ok := relative(root, name)
+	if !ok || rel == "." {
+		// The watched paths themselves are always watched
+		return false
+	}
+
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+
+		partIsDir := isDir || i < len(parts)-1
+		if f.excluded(root, filepath.Join(root, filepath.FromSlash(strings.Join(parts[:i+1], "/"))), partIsDir) {
+			return true
+		}
+	}
+
+	if isDir {
+		return false
+	}
+
+	if len(f.include) > 0 && !matchAny(f.include, root, name, false) {
+		return true
+	}
+
+	return f.action(name) == ActionIgnore
+}
+
+// Applies the exclude rules in order, the last matching rule wins
+func (f *filter) excluded(root, name string, isDir bool) bool {
+	excluded := false
+	for _, r := range f.exclude {
+		if r.matchName(root, name, isDir) {
+			excluded = !r.negate
+		}
+	}
+	return excluded
+}
+
+func matchAny(rules []rule, root, name string, isDir bool) bool {
+	for _, r := range rules {
+		if r.matchName(root, name, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rule) matchName(root, name string, isDir bool) bool {
+	dir := r.dir
+	if dir == "" {
+		dir = root
+	}
+
+	rel, ok := relative(dir, name)
+	return ok && rel != "." && r.match(rel, isDir)
+}
+
+// The action of the file based on its extension
+func (f *filter) action(name string) Action {
+	return f.actions[strings.ToLower(filepath.Ext(name))]
+}
+
+// Reports whether all the changed paths are handled as stylesheets
+func (f *filter) onlyStylesheets(paths []string) bool {
+	for _, path := range paths {
+		if f.action(path) != ActionCSS {
+			return false
+		}
+	}
+	return len(paths) > 0
+}
@@ -1,146 +1,416 @@
 package livereload
 
 import (
+	"bytes"
 	"context"
 	"embed"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/nesbyte/loadr/registry"
 )
 
-//go:embed liveReloader.html
+//go:embed liveReloader.html errorPage.html
 var liveReloaderHTML embed.FS
 
-type clientChan chan string
+type clientChan chan Event
+
+type ReloadHandler func(fsnotify.Event, error)
 
 var (
-	liveServerStarted bool = false
-	liveServerMu      sync.Mutex
-	clientsMu         sync.Mutex
-	clientsRegister   = make(map[clientChan]struct{})
+	liveServerMu sync.Mutex
+	running      *LiveReloader // The started LiveReloader, only one can run at a time
 )
 
-// Broadcasts a message to all connected clients
-func broadcast(msg string) {
-	clientsMu.Lock()
-	defer clientsMu.Unlock()
+// Passes the error to the handleReload of the running live reload, if any
+func LiveReloadCustomErrorHandler(err error) {
+	liveServerMu.Lock()
+	lr := running
+	liveServerMu.Unlock()
 
-	for ch := range clientsRegister {
-		select {
-		case ch <- msg:
-		default:
-		}
+	if lr != nil {
+		lr.opts.OnReload(fsnotify.Event{}, err)
 	}
 }
 
-type ReloadHandler func(fsnotify.Event, error)
+// The options of a LiveReloader
+type Options struct {
+	HandlePattern string        // The URL path the live reload handler is served on
+	OnReload      ReloadHandler // Called on every reload or error, required in order to propagate errors
+	PathsToWatch  []string      // Watched recursively for changes, together with the SourceDir of the template configs
+	Heartbeat     time.Duration // Interval of the heartbeat comments (or WebSocket pings) sent to idle clients, 15s if not set
+	WebSocket     bool          // The injected client connects over a WebSocket instead of Server-Sent Events, the handler serves both
+
+	// Origins of the pages allowed to connect over a WebSocket besides the host
+	// of the handler, such as "http://localhost:5173", "*" allows any origin
+	AllowedOrigins []string
+
+	// Filters the files and directories below PathsToWatch, applied both to the
+	// initial walk and to the change events. See the filter type for the pattern syntax.
+	Include     []string          // Patterns of the files which are watched, all files if empty
+	Exclude     []string          // Patterns of the files and directories which are not watched
+	IgnoreFiles []string          // .gitignore style files adding to Exclude, their patterns are relative to their directory
+	Extensions  map[string]Action // How the changes are handled per extension such as ".scss", .go is ignored and .css swapped in place by default
+
+	// The source of the change events, closed together with the LiveReloader.
+	// The notifications of the operating system are used if nil,
+	// use NewPollingWatcher where they are missing.
+	Watcher Watcher
+
+	// The registries whose templates are reloaded on changes,
+	// the default registry if empty
+	Registries []*registry.Registry
+}
 
-var customReloadHandler ReloadHandler
+// Watches files for changes, reloads the affected templates and
+// notifies the connected clients through its http.Handler.
+//
+// Only one LiveReloader can run at a time, once closed a new one can be started.
+type LiveReloader struct {
+	opts   Options
+	filter *filter
+
+	mu      sync.Mutex
+	started bool
+	closed  bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup // The watcher goroutine and the connected clients
+
+	clientsMu sync.Mutex
+	clients   map[clientChan]struct{}
+	instance  string  // Identifies this LiveReloader in the event ids
+	seq       uint64  // The sequence of the last event sent
+	history   []Event // The last events sent, for clients resuming with a Last-Event-ID
+}
 
-func LiveReloadCustomErrorHandler(err error) {
-	customReloadHandler(fsnotify.Event{}, err)
+// Creates a new LiveReloader, nothing is watched until Start is called
+func New(opts Options) *LiveReloader {
+	return &LiveReloader{
+		opts:    opts,
+		clients: make(map[clientChan]struct{}),
+	}
 }
 
-func RunLiveReload(handlePattern string, handleReload ReloadHandler, pathsToWatch ...string) (http.HandlerFunc, context.CancelFunc, error) {
+// Starts watching the paths and enables live reloading for the templates.
+//
+// The templates of the registries are then loaded again, so the ones loaded
+// before are read from their SourceDir, and the errors are passed to OnReload.
+//
+// An error is returned if another LiveReloader is running
+// or if the LiveReloader has already been started.
+func (lr *LiveReloader) Start() error {
+	err := lr.start()
+	if err != nil {
+		return err
+	}
+
+	err = lr.loadAll()
+	if err != nil {
+		lr.opts.OnReload(fsnotify.Event{}, err)
+	}
+	return nil
+}
+
+func (lr *LiveReloader) start() error {
+	if lr.opts.HandlePattern == "" {
+		return errors.New("handlePattern can not be empty")
+	}
+
+	if lr.opts.OnReload == nil {
+		return errors.New("handleChange must be set in order to propagate errors, feel free to use loadr.HandleChange as a helper")
+	}
 
 	liveServerMu.Lock()
 	defer liveServerMu.Unlock()
 
-	if liveServerStarted {
-		return nil, nil, errors.New("live reload is already running")
+	if running != nil {
+		return errors.New("live reload is already running")
 	}
-	liveServerStarted = true
 
-	if handlePattern == "" {
-		return nil, nil, errors.New("handlePattern can not be empty")
-	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
 
-	if handleReload == nil {
-		return nil, nil, errors.New("handleChange must be set in order to propagate errors, feel free to use loadr.HandleChange as a helper")
-	} else {
-		customReloadHandler = handleReload
+	if lr.started {
+		return errors.New("live reload has already been started, create a new one to restart")
 	}
 
-	bs, err := liveReloaderHTML.ReadFile("liveReloader.html")
+	js, err := injectedJS(lr.opts.HandlePattern, lr.opts.WebSocket)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	registry.SetJSToInject(bs)
 
-	watcher, err := fsnotify.NewWatcher()
+	// The source directories of the templates are watched as well
+	lr.opts.Registries = slices.Clone(lr.opts.Registries)
+	lr.opts.PathsToWatch = slices.Clone(lr.opts.PathsToWatch)
+	for _, dir := range registry.SourceDirs() {
+		if !slices.Contains(lr.opts.PathsToWatch, dir) {
+			lr.opts.PathsToWatch = append(lr.opts.PathsToWatch, dir)
+		}
+	}
+
+	lr.filter, err = newFilter(lr.opts)
 	if err != nil {
-		return nil, nil, err
+		return err
+	}
+
+	watcher := lr.opts.Watcher
+	if watcher == nil {
+		watcher, err = newFsnotifyWatcher()
+		if err != nil {
+			return err
+		}
 	}
 
 	// Recursively adds directories to the watcher
-	err = walkDirsAndAddPaths(watcher, pathsToWatch)
+	err = walkDirsAndAddPaths(watcher, lr.filter, lr.opts.PathsToWatch)
 	if err != nil {
-		return nil, nil, err
+		watcher.Close()
+		return err
+	}
+
+	lr.ctx, lr.cancel = context.WithCancel(context.Background())
+	lr.instance = strconv.FormatInt(time.Now().UnixNano(), 36)
+	lr.started = true
+	running = lr
+
+	lr.wg.Add(1)
+	go func() {
+		defer lr.wg.Done()
+		lr.runWatcher(watcher)
+	}()
+
+	// Register live reloading with the validator
+	registry.SetJSToInject(js)
+	registry.SetLiveReload(true)
+
+	return nil
+}
+
+// Stops watching, disables live reloading and disconnects all clients.
+//
+// Close waits for the watcher and the client handlers to finish, if ctx is
+// done first its error is returned. Calling Close more than once is a no-op.
+func (lr *LiveReloader) Close(ctx context.Context) error {
+	lr.mu.Lock()
+	if !lr.started || lr.closed {
+		lr.mu.Unlock()
+		return nil
+	}
+	lr.closed = true
+	lr.cancel()
+	lr.mu.Unlock()
+
+	liveServerMu.Lock()
+	if running == lr {
+		running = nil
+		registry.SetLiveReload(false)
+		registry.SetJSToInject(nil)
+	}
+	liveServerMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		lr.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Registers a client, returning the connected event and the events missed
+// since the lastEventID. false is returned if the LiveReloader is not running.
+func (lr *LiveReloader) addClient(ch clientChan, lastEventID string) (connected Event, missed []Event, ok bool) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	if !lr.started || lr.closed {
+		return Event{}, nil, false
+	}
+	lr.wg.Add(1)
+
+	lr.clientsMu.Lock()
+	defer lr.clientsMu.Unlock()
+
+	lr.clients[ch] = struct{}{}
+
+	connected = Event{ID: eventID(lr.instance, lr.seq), Type: EventConnected}
+	return connected, lr.missedEvents(lastEventID), true
+}
+
+func (lr *LiveReloader) removeClient(ch clientChan) {
+	lr.clientsMu.Lock()
+	delete(lr.clients, ch)
+	lr.clientsMu.Unlock()
+
+	lr.wg.Done()
+}
+
+// Returns the events sent after lastEventID, or a reload if they are no longer
+// known or the id belongs to another instance. Must be called with clientsMu held.
+func (lr *LiveReloader) missedEvents(lastEventID string) []Event {
+	if lastEventID == "" {
+		return nil
+	}
+
+	reload := []Event{{ID: eventID(lr.instance, lr.seq), Type: EventReload}}
+
+	instance, seq, ok := parseEventID(lastEventID)
+	if !ok || instance != lr.instance || seq > lr.seq {
+		return reload
+	}
+
+	n := lr.seq - seq
+	if n > uint64(len(lr.history)) {
+		return reload
+	}
+	return append([]Event(nil), lr.history[uint64(len(lr.history))-n:]...)
+}
+
+// Broadcasts the event to all connected clients
+func (lr *LiveReloader) broadcast(e Event) {
+	lr.clientsMu.Lock()
+	defer lr.clientsMu.Unlock()
+
+	lr.seq++
+	e.ID = eventID(lr.instance, lr.seq)
+
+	lr.history = append(lr.history, e)
+	if len(lr.history) > eventHistorySize {
+		lr.history = lr.history[len(lr.history)-eventHistorySize:]
+	}
+
+	for ch := range lr.clients {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// The id of the last event the client received, sent by the browser as the
+// Last-Event-ID header or by the injected client as the lastEventId query
+// parameter when it reconnects itself
+func lastEventID(r *http.Request) string {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("lastEventId")
+}
+
+func (lr *LiveReloader) heartbeat() time.Duration {
+	if lr.opts.Heartbeat <= 0 {
+		return defaultHeartbeat
 	}
+	return lr.opts.Heartbeat
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	go runWatcher(ctx, watcher, handleReload)
+// The reconnection delay sent to the clients in milliseconds
+const retryMillis = 1000
 
-	// Build up the HTTP handler function
-	handlerFunc := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// Serves the Server-Sent Events which notify the client of changes,
+// or a WebSocket if the request is a WebSocket handshake.
+// See EventReload for the protocol.
+func (lr *LiveReloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isWebSocketUpgrade(r) {
+		lr.serveWebSocket(w, r)
+		return
+	}
 
-		// Register the current client
-		broadcastChannel := make(clientChan, 1)
-		clientsMu.Lock()
-		clientsRegister[broadcastChannel] = struct{}{}
-		clientsMu.Unlock()
+	// Register the current client
+	broadcastChannel := make(clientChan, eventHistorySize)
+	connected, missed, ok := lr.addClient(broadcastChannel, lastEventID(r))
+	if !ok {
+		http.Error(w, "live reload is not running", http.StatusServiceUnavailable)
+		return
+	}
 
-		// Unregister the client
-		defer func() {
-			clientsMu.Lock()
-			delete(clientsRegister, broadcastChannel)
-			clientsMu.Unlock()
-		}()
+	// Unregister the client
+	defer lr.removeClient(broadcastChannel)
 
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
 
-		// Notify the client of the live server start
-		w.Write([]byte("data: live server is running\n\n"))
+	flush := func() {
 		if f, ok := w.(http.Flusher); ok {
 			f.Flush()
 		}
+	}
 
-		// Listen for events from the broadcast channel, client requests, or context cancellation
-		for {
-			select {
-			case msg := <-broadcastChannel:
-				w.Write([]byte(msg))
-				if f, ok := w.(http.Flusher); ok {
-					f.Flush()
-				}
-			case <-r.Context().Done():
-				return
-			case <-ctx.Done():
-				return
-			}
+	// Notify the client of the live server start and of what it missed
+	fmt.Fprintf(w, "retry: %d\n", retryMillis)
+	connected.write(w)
+	for _, e := range missed {
+		e.write(w)
+	}
+	flush()
+
+	ticker := time.NewTicker(lr.heartbeat())
+	defer ticker.Stop()
+
+	// Listen for events from the broadcast channel, client requests, or context cancellation
+	for {
+		select {
+		case e := <-broadcastChannel:
+			e.write(w)
+			flush()
+		case <-ticker.C:
+			w.Write([]byte(": heartbeat\n\n"))
+			flush()
+		case <-r.Context().Done():
+			return
+		case <-lr.ctx.Done():
+			return
 		}
+	}
+}
 
+// Watches the specified local pathsToWatch for file changes and notifies connected clients
+// and handleReload.
+//
+// The returned CancelFunc closes the LiveReloader, see LiveReloader.Close.
+func RunLiveReload(handlePattern string, handleReload ReloadHandler, pathsToWatch ...string) (http.HandlerFunc, context.CancelFunc, error) {
+	return RunLiveReloadWithOptions(Options{
+		HandlePattern: handlePattern,
+		OnReload:      handleReload,
+		PathsToWatch:  pathsToWatch,
 	})
+}
 
-	// Register live reloading with the validator
-	registry.SetLiveReload(true)
+// The same as RunLiveReload but with all the Options, such as the file filters
+func RunLiveReloadWithOptions(opts Options) (http.HandlerFunc, context.CancelFunc, error) {
+	lr := New(opts)
 
-	return handlerFunc, cancel, nil
+	err := lr.Start()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return lr.ServeHTTP, func() { lr.Close(context.Background()) }, nil
 }
 
 // fsnotify does not support recursive directory watching,
 // so we need to walk through the directories and add them to the watcher manually.
-func walkDirsAndAddPaths(watcher *fsnotify.Watcher, pathsToWatch []string) error {
+// Ignored directories are skipped together with their contents.
+func walkDirsAndAddPaths(watcher Watcher, f *filter, pathsToWatch []string) error {
 	for _, path := range pathsToWatch {
 		err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
@@ -149,6 +419,10 @@ func walkDirsAndAddPaths(watcher *fsnotify.Watcher, pathsToWatch []string) error
 
 			// If it's a directory, add it to the watcher
 			if d.IsDir() {
+				if f.ignored(path, true) {
+					return filepath.SkipDir
+				}
+
 				err := watcher.Add(path)
 				if err != nil {
 					return err
@@ -167,76 +441,153 @@ func walkDirsAndAddPaths(watcher *fsnotify.Watcher, pathsToWatch []string) error
 
 }
 
-const goType = ".go"
+const (
+	goType  = ".go"
+	cssType = ".css"
+)
+
+var liveReloaderJS = template.Must(template.ParseFS(liveReloaderHTML, "liveReloader.html"))
+
+// Renders the JS injected in to the rendered pages which connects to the handlePattern
+func injectedJS(handlePattern string, webSocket bool) ([]byte, error) {
+	// JSON encoding escapes the URL for use as a JS string inside a <script>
+	url, err := json.Marshal(handlePattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	err = liveReloaderJS.Execute(&b, struct {
+		URL       string
+		WebSocket bool
+	}{string(url), webSocket})
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
 
 // The runWatcher function listens for file system events, debounces
 // them to avoid multiple notifications for the same file change, and
 // broadcasts changes to all connected clients
-func runWatcher(ctx context.Context, watcher *fsnotify.Watcher, handleChange func(fsnotify.Event, error)) {
+func (lr *LiveReloader) runWatcher(watcher Watcher) {
 	var (
 		batchDelay = 100 * time.Millisecond // Delay for batching events
 		batchTimer *time.Timer
+		batchC     <-chan time.Time            // Fires once the batch is complete
+		batched    = make(map[string]struct{}) // The changed paths of the batch
+		lastEvent  fsnotify.Event
 	)
 
+	handleChange := lr.opts.OnReload
+
 	defer watcher.Close()
+	defer func() {
+		if batchTimer != nil {
+			batchTimer.Stop()
+		}
+	}()
+
 	for {
 		select {
-		case <-ctx.Done():
+		case <-lr.ctx.Done():
 			return
-		case event, ok := <-watcher.Events:
+		case event, ok := <-watcher.Events():
 			if !ok {
 				return
 			}
 
-			// ignore Go files, as they are not relevant for live reloading
-			eventNameLength := len(event.Name)
-			if (eventNameLength > 0) && (event.Name[eventNameLength-len(goType):eventNameLength] == goType) {
-				continue
-			}
-
-			// If the event was to create a folder, we need to add it to the watcher
-			// regardless of the timer
+			isDir := false
 			if event.Has(fsnotify.Create) {
 				fi, err := os.Stat(event.Name)
 				if err != nil {
-					if handleChange != nil {
-						handleChange(fsnotify.Event{}, err)
-					}
+					handleChange(fsnotify.Event{}, err)
 					continue
 				}
+				isDir = fi.IsDir()
+			}
 
-				if fi.IsDir() && len(fi.Name()) != 0 {
-					// Ignore dotfiles
-					if (len(event.Name) > 0) && (event.Name[0] != '.') {
-						walkDirsAndAddPaths(watcher, []string{event.Name})
-					}
-				}
+			if lr.filter.ignored(event.Name, isDir) {
+				continue
+			}
+
+			// If the event was to create a folder, we need to add it to the watcher
+			// regardless of the timer
+			if isDir {
+				walkDirsAndAddPaths(watcher, lr.filter, []string{event.Name})
 			}
 
+			batched[event.Name] = struct{}{}
+			lastEvent = event
+
 			// Avoid multiple notifications for the same file change
 			if batchTimer != nil {
 				batchTimer.Stop()
 			}
-
-			batchTimer = time.AfterFunc(batchDelay, func() {
-				if handleChange != nil {
-					handleChange(event, nil)
+			batchTimer = time.NewTimer(batchDelay)
+			batchC = batchTimer.C
+		case <-batchC:
+			batchC = nil
+
+			paths := make([]string, 0, len(batched))
+			for path := range batched {
+				paths = append(paths, filepath.ToSlash(path))
+			}
+			clear(batched)
+			sort.Strings(paths)
+
+			// Reload and swap in only the affected templates before the clients reload
+			err := lr.loadChanged(paths)
+			handleChange(lastEvent, err)
+
+			// Stylesheets are swapped in place by the client, anything else reloads the page
+			if lr.filter.onlyStylesheets(paths) {
+				lr.broadcast(Event{Type: EventCSS, Paths: paths})
+			} else {
+				e := Event{Type: EventReload, Paths: paths}
+				if err != nil {
+					e.Error = err.Error()
 				}
-
-				// Trigger a reload event
-				broadcast("data: reload\n\n")
-			})
-		case err, ok := <-watcher.Errors:
+				lr.broadcast(e)
+			}
+		case err, ok := <-watcher.Errors():
 			if !ok {
 				return
 			}
 
-			if handleChange != nil {
-				handleChange(fsnotify.Event{}, err)
-			}
+			handleChange(fsnotify.Event{}, err)
 
-			// Trigger a reload event
-			broadcast(fmt.Sprintf("data: live reload error: %s\n\n", err.Error()))
+			lr.broadcast(Event{Type: EventError, Error: err.Error()})
+		}
+	}
+}
+
+// Reloads the templates depending on the changed paths in every registry,
+// the errors of all registries are joined
+func (lr *LiveReloader) loadChanged(paths []string) error {
+	return lr.forRegistries(func(r *registry.Registry) error {
+		return r.LoadChanged(paths)
+	})
+}
+
+// Loads the templates of every registry, the errors of all registries are joined
+func (lr *LiveReloader) loadAll() error {
+	return lr.forRegistries((*registry.Registry).LoadTemplates)
+}
+
+// Calls load with every registry, the default registry if none are set
+func (lr *LiveReloader) forRegistries(load func(r *registry.Registry) error) error {
+	registries := lr.opts.Registries
+	if len(registries) == 0 {
+		registries = []*registry.Registry{registry.Default()}
+	}
+
+	var errs []error
+	for _, r := range registries {
+		err := load(r)
+		if err != nil {
+			errs = append(errs, err)
 		}
 	}
+	return errors.Join(errs...)
 }
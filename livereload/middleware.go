@@ -0,0 +1,215 @@
+package livereload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/nesbyte/loadr/registry"
+)
+
+// Injects the live reload client in to the text/html responses of next,
+// for pages which are not rendered by a Templ such as static files,
+// reverse-proxied frontends and error pages.
+//
+// The HTML responses are buffered in full to insert the client before the
+// closing body tag, or at the end if there is none, and to correct the
+// Content-Length. Gzip encoded responses are decoded and encoded again,
+// responses which already contain the client are left as is.
+// Any other response, and every response while live reload is disabled,
+// is passed through untouched.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !registry.LiveReload() || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		iw := &injectWriter{ResponseWriter: w}
+		next.ServeHTTP(iw, r)
+		iw.finish()
+	})
+}
+
+// Buffers the response if it is to be injected
+type injectWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	sniff       bool // Set until the first write if the content type has to be sniffed to decide
+	inject      bool
+	buf         bytes.Buffer
+}
+
+func (w *injectWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+
+	// Informational responses are followed by the actual response
+	if status >= 100 && status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.wroteHeader = true
+	w.status = status
+
+	// Sniffed as net/http would, which is only possible once the body is written
+	h := w.Header()
+	if _, ok := h["Content-Type"]; !ok && h.Get("Content-Encoding") == "" {
+		w.sniff = true
+		return
+	}
+
+	w.decide()
+}
+
+// Decides whether the response is injected, writing the header if it is not
+func (w *injectWriter) decide() {
+	w.sniff = false
+	w.inject = injectable(w.Header(), w.status)
+
+	if !w.inject {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+func (w *injectWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.sniff {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(b))
+		w.decide()
+	}
+
+	if w.inject {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flushes the responses passed through, the injected ones are only written once complete
+func (w *injectWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.sniff {
+		w.decide()
+	}
+	if w.inject {
+		return
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Allows http.ResponseController to reach the underlying ResponseWriter
+func (w *injectWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Writes the buffered response with the client injected
+func (w *injectWriter) finish() {
+	if w.sniff {
+		// Nothing was written
+		w.ResponseWriter.WriteHeader(w.status)
+		return
+	}
+	if !w.inject {
+		return
+	}
+
+	body := w.buf.Bytes()
+	h := w.Header()
+
+	if len(body) == 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+		return
+	}
+
+	if h.Get("Content-Encoding") == "gzip" {
+		injected, err := injectGzip(body)
+		if err == nil {
+			body = injected
+		}
+	} else {
+		body = injectJS(body, []byte(registry.JSToInject()))
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
+
+// Reports whether the response is HTML with a body which can be injected
+func injectable(h http.Header, status int) bool {
+	switch status {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		return false
+	}
+
+	switch h.Get("Content-Encoding") {
+	case "", "identity", "gzip":
+	default:
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mediaType == "text/html"
+}
+
+func injectGzip(body []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	html, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write(injectJS(html, []byte(registry.JSToInject())))
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Inserts the js before the last closing body tag, or at the end if there
+// is none, unless it has already been injected such as by Templ.Render
+func injectJS(html, js []byte) []byte {
+	if len(js) == 0 || bytes.Contains(html, js) {
+		return html
+	}
+
+	idx := lastIndexFold(html, []byte("</body>"))
+	if idx == -1 {
+		idx = len(html)
+	}
+
+	injected := make([]byte, 0, len(html)+len(js))
+	injected = append(injected, html[:idx]...)
+	injected = append(injected, js...)
+	return append(injected, html[idx:]...)
+}
+
+// The index of the last ASCII case-insensitive occurrence of substr in s
+func lastIndexFold(s, substr []byte) int {
+	for i := len(s) - len(substr); i >= 0; i-- {
+		if bytes.EqualFold(s[i:i+len(substr)], substr) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,285 @@
+package livereload
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// The source of the file change events of a LiveReloader.
+//
+// Directories are added one at a time, the LiveReloader walks the watched
+// paths itself and adds the directories which are created afterwards.
+// Only the events of the direct entries of an added directory are expected.
+type Watcher interface {
+	Add(dir string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+// The default Watcher using the notifications of the operating system
+type fsnotifyWatcher struct {
+	w *fsnotify.Watcher
+}
+
+func newFsnotifyWatcher() (Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return fsnotifyWatcher{w}, nil
+}
+
+func (w fsnotifyWatcher) Add(dir string) error          { return w.w.Add(dir) }
+func (w fsnotifyWatcher) Events() <-chan fsnotify.Event { return w.w.Events }
+func (w fsnotifyWatcher) Errors() <-chan error          { return w.w.Errors }
+func (w fsnotifyWatcher) Close() error                  { return w.w.Close() }
+
+// What the PollingWatcher compares to detect that a file has changed
+type Compare uint8
+
+const (
+	CompareModTime Compare = 1 << iota
+	CompareSize
+	CompareHash // Reads every watched file on every poll, for when the modification times are unreliable
+)
+
+// A Watcher which scans the directories at an interval, for file systems
+// where the notifications are missing such as bind-mounted Docker volumes,
+// NFS and some WSL setups.
+type PollingWatcher struct {
+	interval time.Duration
+	compare  Compare
+	events   chan fsnotify.Event
+	errors   chan error
+
+	mu   sync.Mutex
+	dirs map[string]map[string]fileState // The entries of the watched directories by name
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// The state of a directory entry as of the last poll
+type fileState struct {
+	isDir   bool
+	modTime time.Time
+	size    int64
+	hash    uint64
+}
+
+// Creates a PollingWatcher scanning the added directories every interval,
+// 1s if not set. A file has changed if any of compare differs,
+// CompareModTime|CompareSize if not set.
+func NewPollingWatcher(interval time.Duration, compare Compare) *PollingWatcher {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	if compare == 0 {
+		compare = CompareModTime | CompareSize
+	}
+
+	w := &PollingWatcher{
+		interval: interval,
+		compare:  compare,
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		dirs:     make(map[string]map[string]fileState),
+		done:     make(chan struct{}),
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.run()
+	}()
+
+	return w
+}
+
+// Watches the entries of the directory, the current entries are
+// recorded without sending any events
+func (w *PollingWatcher) Add(dir string) error {
+	entries, err := w.scan(dir)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.dirs[dir] = entries
+	return nil
+}
+
+func (w *PollingWatcher) Events() <-chan fsnotify.Event { return w.events }
+func (w *PollingWatcher) Errors() <-chan error          { return w.errors }
+
+// Stops polling, calling Close more than once is a no-op
+func (w *PollingWatcher) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.done)
+		w.wg.Wait()
+	})
+	return nil
+}
+
+func (w *PollingWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if !w.poll() {
+				return
+			}
+		}
+	}
+}
+
+// Scans every watched directory and sends the differences to the last poll,
+// false is returned if the watcher was closed meanwhile
+func (w *PollingWatcher) poll() bool {
+	w.mu.Lock()
+	dirs := make([]string, 0, len(w.dirs))
+	for dir := range w.dirs {
+		dirs = append(dirs, dir)
+	}
+	w.mu.Unlock()
+
+	for _, dir := range dirs {
+		entries, err := w.scan(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			// The removal is sent by the parent directory
+			w.mu.Lock()
+			delete(w.dirs, dir)
+			w.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			if !w.send(nil, err) {
+				return false
+			}
+			continue
+		}
+
+		w.mu.Lock()
+		previous, ok := w.dirs[dir]
+		if ok {
+			w.dirs[dir] = entries
+		}
+		w.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		for name, state := range entries {
+			before, existed := previous[name]
+			switch {
+			case !existed:
+				if !w.send(&fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Create}, nil) {
+					return false
+				}
+			case !state.isDir && w.changed(before, state):
+				if !w.send(&fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Write}, nil) {
+					return false
+				}
+			}
+		}
+
+		for name := range previous {
+			if _, exists := entries[name]; !exists {
+				if !w.send(&fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Remove}, nil) {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+func (w *PollingWatcher) changed(before, after fileState) bool {
+	return (w.compare&CompareModTime != 0 && !before.modTime.Equal(after.modTime)) ||
+		(w.compare&CompareSize != 0 && before.size != after.size) ||
+		(w.compare&CompareHash != 0 && before.hash != after.hash)
+}
+
+// Sends the event or the error, false is returned if the watcher was closed first
+func (w *PollingWatcher) send(event *fsnotify.Event, err error) bool {
+	if event != nil {
+		select {
+		case w.events <- *event:
+			return true
+		case <-w.done:
+			return false
+		}
+	}
+
+	select {
+	case w.errors <- err:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// Reads the state of the entries of the directory
+func (w *PollingWatcher) scan(dir string) (map[string]fileState, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(map[string]fileState, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed since reading the directory
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		state := fileState{isDir: info.IsDir(), modTime: info.ModTime(), size: info.Size()}
+		if !state.isDir && w.compare&CompareHash != 0 {
+			state.hash, err = hashFile(filepath.Join(dir, entry.Name()))
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		states[entry.Name()] = state
+	}
+	return states, nil
+}
+
+func hashFile(name string) (uint64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	h := fnv.New64a()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return 0, err
+	}
+	return h.Sum64(), nil
+}
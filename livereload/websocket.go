@@ -0,0 +1,316 @@
+package livereload
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal server side implementation of RFC 6455, only what is needed to
+// push the events to the clients: text messages are sent and any data
+// messages received are discarded.
+
+// Appended to the Sec-WebSocket-Key to compute the Sec-WebSocket-Accept
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close status codes
+const (
+	closeNormal        = 1000
+	closeGoingAway     = 1001
+	closeProtocolError = 1002
+	closeTooBig        = 1009
+)
+
+const (
+	maxMessageSize    = 64 << 10 // Received messages are discarded, but not without bounds
+	webSocketDeadline = 10 * time.Second
+)
+
+var (
+	errProtocol = errors.New("websocket: protocol error")
+	errTooBig   = errors.New("websocket: message too big")
+)
+
+// Reports whether the request is a WebSocket handshake
+func isWebSocketUpgrade(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		headerContains(r.Header, "Connection", "upgrade") &&
+		headerContains(r.Header, "Upgrade", "websocket")
+}
+
+// Reports whether the comma separated header contains the token
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reports whether the page the handshake comes from may connect, either served
+// by the same host or one of the AllowedOrigins. Browsers do not apply CORS to
+// WebSockets, so any website could otherwise read the events.
+func (lr *LiveReloader) allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true // Not sent by a browser
+	}
+
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range lr.opts.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Serves the events over a WebSocket, see EventReload for the protocol
+func (lr *LiveReloader) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket handshake", http.StatusBadRequest)
+		return
+	}
+
+	if !lr.allowedOrigin(r) {
+		http.Error(w, "websocket origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	// Register the current client before upgrading, as the error can not be sent afterwards
+	broadcastChannel := make(clientChan, eventHistorySize)
+	connected, missed, ok := lr.addClient(broadcastChannel, lastEventID(r))
+	if !ok {
+		http.Error(w, "live reload is not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Unregister the client
+	defer lr.removeClient(broadcastChannel)
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ws := &webSocketConn{conn: conn, rw: rw}
+
+	// Stop the reader before the client is unregistered
+	closed := make(chan struct{})
+	defer func() {
+		conn.Close()
+		<-closed
+	}()
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n")
+
+	go func() {
+		defer close(closed)
+		ws.readLoop()
+	}()
+
+	// Notify the client of the live server start and of what it missed
+	for _, e := range append([]Event{connected}, missed...) {
+		if ws.writeEvent(e) != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(lr.heartbeat())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e := <-broadcastChannel:
+			if ws.writeEvent(e) != nil {
+				return
+			}
+		case <-ticker.C:
+			if ws.writeFrame(opPing, nil) != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-lr.ctx.Done():
+			ws.writeClose(closeGoingAway)
+			return
+		}
+	}
+}
+
+// A hijacked connection after the handshake
+type webSocketConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	mu sync.Mutex // Serialises the writes of the handler and the reader
+}
+
+func (ws *webSocketConn) writeEvent(e Event) error {
+	data, err := e.message()
+	if err != nil {
+		return err
+	}
+	return ws.writeFrame(opText, data)
+}
+
+func (ws *webSocketConn) writeClose(code uint16) error {
+	return ws.writeFrame(opClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+// Writes a single unmasked frame, as sent by servers
+func (ws *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	header := []byte{0x80 | opcode} // FIN set, the messages are never fragmented
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	ws.conn.SetWriteDeadline(time.Now().Add(webSocketDeadline))
+	ws.rw.Write(header)
+	ws.rw.Write(payload)
+	return ws.rw.Flush()
+}
+
+// Reads the frames of the client until the connection is closed,
+// answering pings and the closing handshake
+func (ws *webSocketConn) readLoop() {
+	size := 0 // Of the message being received
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if errors.Is(err, errProtocol) {
+			ws.writeClose(closeProtocolError)
+			return
+		}
+		if errors.Is(err, errTooBig) {
+			ws.writeClose(closeTooBig)
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		switch opcode {
+		case opPing:
+			ws.writeFrame(opPong, payload)
+		case opPong:
+		case opClose:
+			// Echo the status code to complete the closing handshake
+			code := uint16(closeNormal)
+			if len(payload) >= 2 {
+				code = binary.BigEndian.Uint16(payload)
+			}
+			ws.writeClose(code)
+			return
+		case opText, opBinary, opContinuation:
+			size += len(payload)
+			if size > maxMessageSize {
+				ws.writeClose(closeTooBig)
+				return
+			}
+			if fin {
+				size = 0
+			}
+		default:
+			ws.writeClose(closeProtocolError)
+			return
+		}
+	}
+}
+
+// Reads a single frame, unmasking its payload
+func (ws *webSocketConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(ws.rw, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	n := uint64(header[1] & 0x7F)
+
+	// Clients must mask their frames and control frames can not be fragmented or extended
+	if header[0]&0x70 != 0 || !masked || (opcode >= opClose && (!fin || n > 125)) {
+		return false, 0, nil, errProtocol
+	}
+
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.rw, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.rw, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > maxMessageSize {
+		return false, 0, nil, errTooBig
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.rw, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(ws.rw, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
@@ -2,6 +2,7 @@ package loadr
 
 import (
 	"context"
+	"html/template"
 	"log"
 	"net/http"
 
@@ -38,24 +39,121 @@ func NewTemplate[T, U any](tc *core.TemplateContext[T], pattern string, data U)
 	return core.NewTemplate(tc, pattern, data)
 }
 
-// Loads and validates all the created templates.
+// Adds funcs available to the templates of every TemplateContext of the
+// default registry, see TemplateContext.Funcs for how they are merged
+func Funcs(funcMap template.FuncMap) {
+	registry.Funcs(funcMap)
+}
+
+// Loads and validates all the created templates of the default registry.
 // It is expected to be called after all the templates and settings have been created
+//
+// All templates are loaded, the returned error joins the *core.LoadingError
+// of every failing template in the order the templates were created.
 func LoadTemplates() error {
 	return registry.LoadTemplates()
 }
 
+// Reloads all the templates of the default registry at runtime, for example
+// when the templates are read from a mounted volume.
+//
+// The templates are only swapped in if every template loads and validates,
+// otherwise the joined errors are returned and the previous templates are kept.
+func Reload() error {
+	return registry.Reload()
+}
+
+// Returns an http.Handler which calls Reload on POST requests.
+// It responds with 204 No Content on success and 500 with the
+// errors in the body if any template failed to reload.
+//
+// As the errors reveal template details, the handler should
+// not be publicly reachable.
+func ReloadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		err := Reload()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Sets the maximum number of templates loaded concurrently by LoadTemplates.
+// If n < 1, GOMAXPROCS is used which is also the default.
+func SetLoadConcurrency(n int) {
+	registry.SetConcurrency(n)
+}
+
+// A set of templates which are loaded and validated together,
+// use TemplateContext.SetRegistry to bind a TemplateContext to it
+type Registry = registry.Registry
+
+// Creates a new registry independent of the default registry
+// used by LoadTemplates. It is only live reloaded if it is
+// set in the LiveReloadOptions.Registries.
+func NewRegistry() *Registry {
+	return registry.New()
+}
+
 // Watches the specified local pathsToWatch for file changes and notifies connected clients
 // and handleChange if provided.
 //
-// Live reload can only be started once.
+// Only one live reload can run at a time, calling the returned CancelFunc
+// stops it and allows it to be started again.
 //
 // The handlePattern is the URL path that the live server will handle and must match the
 // registered pattern in the HTTP server.
-// If no handlePatern is provided, the live server will serve on /live-server
 func RunLiveReload(handlePattern string, handleReload func(fsnotify.Event, error), pathsToWatch ...string) (http.HandlerFunc, context.CancelFunc, error) {
 	return livereload.RunLiveReload(handlePattern, handleReload, pathsToWatch...)
 }
 
+// The same as RunLiveReload but with all the options, such as the
+// Include, Exclude and IgnoreFiles filters of the watched files
+func RunLiveReloadWithOptions(opts LiveReloadOptions) (http.HandlerFunc, context.CancelFunc, error) {
+	return livereload.RunLiveReloadWithOptions(opts)
+}
+
+// Watches files for changes and notifies the clients connected to it,
+// use it instead of RunLiveReload for control over its lifetime
+type LiveReloader = livereload.LiveReloader
+
+// The options of a LiveReloader
+type LiveReloadOptions = livereload.Options
+
+// The source of the file change events of a LiveReloader, see
+// livereload.NewPollingWatcher for file systems without notifications
+type LiveReloadWatcher = livereload.Watcher
+
+// How a change to a file is handled, set per extension in LiveReloadOptions.Extensions
+type LiveReloadAction = livereload.Action
+
+const (
+	LiveReloadActionReload = livereload.ActionReload // The templates and the page are reloaded
+	LiveReloadActionCSS    = livereload.ActionCSS    // The stylesheet is swapped in place
+	LiveReloadActionIgnore = livereload.ActionIgnore // The change is ignored
+)
+
+// Injects the live reload client in to the HTML responses of handlers
+// which do not render through a Templ, see livereload.Middleware
+func LiveReloadMiddleware(next http.Handler) http.Handler {
+	return livereload.Middleware(next)
+}
+
+// Creates a LiveReloader which is started with Start and stopped with Close.
+// The LiveReloader is the http.Handler which must be served on the HandlePattern.
+func NewLiveReloader(opts LiveReloadOptions) *LiveReloader {
+	return livereload.New(opts)
+}
+
 // A basic helper function for LiveReload to perform logging when a reload occurs
 func HandleReload(e fsnotify.Event, err error) {
 	if err == nil {
@@ -64,3 +162,12 @@ func HandleReload(e fsnotify.Event, err error) {
 		log.Println("error:", err.Error())
 	}
 }
+
+// Replaces the error page shown in the browser when a template fails to load
+// while live reloading. The template is executed with a livereload.ErrorPage and
+// should include {{.JS}} for the page to refresh once the error is fixed.
+//
+// If nil is provided, the default error page is restored.
+func SetErrorPage(t *template.Template) {
+	livereload.SetErrorPage(t)
+}
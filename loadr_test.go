@@ -1,23 +1,40 @@
 package loadr
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/nesbyte/loadr/core"
+	"github.com/nesbyte/loadr/livereload"
 	"github.com/nesbyte/loadr/registry"
 )
 
 const case1Dir = "./testdata/case1"
 const case2Dir = "./testdata/case2"
 const case3Dir = "./testdata/case3"
+const case4Dir = "./testdata/case4"
+const case5Dir = "./testdata/case5"
+const case6Dir = "./testdata/case6"
+const case7Dir = "./testdata/case7"
 
 type case1BaseData struct {
 	Title string
@@ -269,3 +286,1763 @@ func TestFuncMapFunctionality(t *testing.T) {
 		t.Errorf("want: TEST\ngot: %s\n", b.String())
 	}
 }
+
+// Validates that html/template escaping is used by default
+// and that text/template can be opted in to
+func TestHTMLEscapingAndTextTemplate(t *testing.T) {
+	var (
+		caseFS = os.DirFS(case4Dir)
+	)
+
+	type userData struct {
+		Name string
+	}
+
+	defer registry.Reset()
+	base := NewTemplateContext(BaseConfig{FS: caseFS}, NoData, "input.html")
+	html := NewTemplate(base, "input.html", userData{})
+	text := NewTemplate(base.Copy().SetTextTemplate(true), "input.html", userData{})
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatalf("loadtemplates failed: %s", err)
+	}
+
+	name := userData{`<script>alert("x")</script>&`}
+
+	b := bytes.NewBufferString("")
+	html.Render(b, name)
+	want := `<a href="/user?name=%3cscript%3ealert%28%22x%22%29%3c%2fscript%3e%26">&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;&amp;</a>`
+	if b.String() != want {
+		t.Errorf("want: %s\ngot: %s\n", want, b.String())
+	}
+
+	b.Reset()
+	text.Render(b, name)
+	want = `<a href="/user?name=<script>alert("x")</script>&"><script>alert("x")</script>&</a>`
+	if b.String() != want {
+		t.Errorf("want: %s\ngot: %s\n", want, b.String())
+	}
+}
+
+// Validates that RenderE returns an ExecutionError with the failing
+// location instead of panicking
+func TestRenderEExecutionError(t *testing.T) {
+	var (
+		caseFS = os.DirFS(case3Dir)
+	)
+
+	errFailed := errors.New("failed")
+	funcMap := template.FuncMap{
+		"toUpper": func(s string) (string, error) {
+			if s == "fail" {
+				return "", errFailed
+			}
+			return strings.ToUpper(s), nil
+		},
+	}
+
+	type upperData struct {
+		Name string
+	}
+
+	defer registry.Reset()
+	base := NewTemplateContext(BaseConfig{FS: caseFS}, NoData, "input.html").Funcs(funcMap)
+	index := NewTemplate(base, "input.html", upperData{"test"})
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatalf("loadtemplates failed: %s", err)
+	}
+
+	b := bytes.NewBufferString("")
+	err = index.RenderE(b, upperData{"fail"})
+
+	var execErr *core.ExecutionError
+	if !errors.As(err, &execErr) {
+		t.Fatalf("want: *core.ExecutionError\ngot: %v\n", err)
+	}
+	if !errors.Is(err, errFailed) {
+		t.Errorf("want error wrapping: %s\ngot: %s\n", errFailed, err)
+	}
+	want := core.Location{Template: "input.html", Line: 1, Column: 12}
+	if execErr.Location != want {
+		t.Errorf("want location: %s\ngot: %s\n", want, execErr.Location)
+	}
+
+	defer func() {
+		loadingErr, ok := recover().(*core.LoadingError)
+		if !ok || !errors.As(loadingErr, &execErr) {
+			t.Errorf("want *core.LoadingError wrapping the *core.ExecutionError\ngot: %v\n", loadingErr)
+		}
+	}()
+	index.Render(b, upperData{"fail"})
+}
+
+// Fails every write, as a client which has disconnected
+type errWriter struct{ err error }
+
+func (w errWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+// Validates that the writer errors are returned as they are
+// and that Render does not panic on them
+func TestRenderWriterError(t *testing.T) {
+	var (
+		caseFS = os.DirFS(case3Dir)
+	)
+
+	type upperData struct {
+		Name string
+	}
+
+	defer registry.Reset()
+	base := NewTemplateContext(BaseConfig{FS: caseFS}, NoData, "input.html").Funcs(template.FuncMap{"toUpper": strings.ToUpper})
+	index := NewTemplate(base, "input.html", upperData{"test"})
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatalf("loadtemplates failed: %s", err)
+	}
+
+	w := errWriter{errors.New("broken pipe")}
+	err = index.RenderE(w, upperData{"test"})
+
+	var execErr *core.ExecutionError
+	if !errors.Is(err, w.err) || errors.As(err, &execErr) {
+		t.Errorf("want: %s\ngot: %v\n", w.err, err)
+	}
+
+	index.Render(w, upperData{"test"})
+}
+
+// Validates that request-scoped values are available through .Ctx
+// and that a cancelled context aborts the rendering
+func TestRenderCtx(t *testing.T) {
+	var (
+		caseFS = os.DirFS(case5Dir)
+	)
+
+	type userKey struct{}
+
+	defer registry.Reset()
+	base := NewTemplateContext(BaseConfig{FS: caseFS}, NoData, "input.html").
+		ContextFuncs(map[string]core.ContextFunc{
+			"user": func(ctx context.Context) any {
+				user, _ := ctx.Value(userKey{}).(string)
+				return user
+			},
+		})
+	index := NewTemplate(base, "input.html", NoData)
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatalf("loadtemplates failed: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), userKey{}, "<alice>"))
+
+	b := bytes.NewBufferString("")
+	err = index.RenderCtx(ctx, b, NoData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "<p>&lt;alice&gt;</p>" {
+		t.Errorf("want: <p>&lt;alice&gt;</p>\ngot: %s\n", b.String())
+	}
+
+	cancel()
+	b.Reset()
+	err = index.RenderCtx(ctx, b, NoData)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("want error: %s\ngot: %v\n", context.Canceled, err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("want no output\ngot: %s\n", b.String())
+	}
+}
+
+// Validates that no partial output is written when a buffered
+// template fails to execute
+func TestBufferedRender(t *testing.T) {
+	var (
+		caseFS = os.DirFS(case6Dir)
+	)
+
+	funcMap := template.FuncMap{
+		"check": func(ok bool) (string, error) {
+			if !ok {
+				return "", errors.New("check failed")
+			}
+			return "ok", nil
+		},
+	}
+
+	defer registry.Reset()
+	base := NewTemplateContext(BaseConfig{FS: caseFS}, NoData, "input.html").Funcs(funcMap)
+	unbuffered := NewTemplate(base, "input.html", true)
+	buffered := NewTemplate(base.Copy().SetBuffered(true), "input.html", true)
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatalf("loadtemplates failed: %s", err)
+	}
+
+	b := bytes.NewBufferString("")
+	if err = unbuffered.RenderE(b, false); err == nil {
+		t.Fatal("want error, check should fail")
+	}
+	if b.String() != "<p>" {
+		t.Errorf("want partial output: <p>\ngot: %s\n", b.String())
+	}
+
+	b.Reset()
+	if err = buffered.RenderE(b, false); err == nil {
+		t.Fatal("want error, check should fail")
+	}
+	if b.Len() != 0 {
+		t.Errorf("want no output\ngot: %s\n", b.String())
+	}
+
+	b.Reset()
+	if err = buffered.RenderE(b, true); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "<p>ok</p>" {
+		t.Errorf("want: <p>ok</p>\ngot: %s\n", b.String())
+	}
+
+	// Writing the output after a successful execution is not an execution error
+	w := errWriter{errors.New("broken pipe")}
+	var execErr *core.ExecutionError
+	if err = buffered.RenderE(w, true); !errors.Is(err, w.err) || errors.As(err, &execErr) {
+		t.Errorf("want: %s\ngot: %v\n", w.err, err)
+	}
+	buffered.Render(w, true)
+}
+
+// Validates that the error page with the offending source is rendered
+// when a template fails to load while live reloading
+func TestLiveReloadErrorPage(t *testing.T) {
+	var (
+		caseFS = os.DirFS(case7Dir)
+	)
+
+	type pageData struct {
+		Name string
+	}
+
+	defer registry.Reset()
+	registry.SetLiveReload(true)
+	defer registry.SetLiveReload(false)
+
+	base := NewTemplateContext(BaseConfig{FS: caseFS}, NoData, "input.html")
+	index := NewTemplate(base, "input.html", pageData{})
+
+	err := LoadTemplates()
+	if !errors.Is(err, core.ErrInvalidTemplateData) {
+		t.Fatalf("want error: %s\ngot: %v\n", core.ErrInvalidTemplateData, err)
+	}
+
+	b := bytes.NewBufferString("")
+	err = index.RenderE(b, pageData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"input.html:3:",
+		`<span class="number">3</span>    &lt;p&gt;{{.D.Missing}}&lt;/p&gt;`,
+		"can&#39;t evaluate field Missing",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("want error page containing: %s\ngot: %s\n", want, b.String())
+		}
+	}
+
+	custom := template.Must(template.New("").Parse("custom: {{.File}}:{{.Line}}"))
+	SetErrorPage(custom)
+	defer SetErrorPage(nil)
+
+	b.Reset()
+	index.Render(b, pageData{})
+	if b.String() != "custom: input.html:3" {
+		t.Errorf("want: custom: input.html:3\ngot: %s\n", b.String())
+	}
+}
+
+// Validates that separate registries load and reset independently
+func TestIndependentRegistries(t *testing.T) {
+	t.Parallel()
+
+	var (
+		caseFS = os.DirFS(case1Dir)
+	)
+
+	valid := NewRegistry()
+	invalid := NewRegistry()
+	t.Cleanup(valid.Reset)
+	t.Cleanup(invalid.Reset)
+
+	b := NewTemplateContext(BaseConfig{FS: caseFS}, case1BaseData{}, "input.html")
+	p1 := b.WithTemplates("input.partial1.html").SetRegistry(valid)
+	p2 := b.WithTemplates("input.partial2.html").SetRegistry(invalid)
+
+	_ = NewTemplate(p1, "partial", case1Partial1{})
+	_ = NewTemplate(p2, "partial", case1Partial1{}) // wrong data type
+
+	if err := valid.LoadTemplates(); err != nil {
+		t.Error(err)
+	}
+	if err := invalid.LoadTemplates(); !errors.Is(err, core.ErrInvalidTemplateData) {
+		t.Errorf("want error: %s\ngot: %v\n", core.ErrInvalidTemplateData, err)
+	}
+	if err := LoadTemplates(); err != nil {
+		t.Errorf("want default registry to be unaffected\ngot: %s\n", err)
+	}
+
+	invalid.Reset()
+	if err := invalid.LoadTemplates(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Validates that a copy bound to another registry does not reuse
+// the base templates parsed with the funcs of the first registry
+func TestCopyToOtherRegistry(t *testing.T) {
+	fsys := fstest.MapFS{"index.html": {Data: []byte(`{{name}}`)}}
+
+	r1 := NewRegistry()
+	r2 := NewRegistry()
+	t.Cleanup(r1.Reset)
+	t.Cleanup(r2.Reset)
+	r1.Funcs(template.FuncMap{"name": func() string { return "r1" }})
+	r2.Funcs(template.FuncMap{"name": func() string { return "r2" }})
+
+	base := NewTemplateContext(BaseConfig{FS: fsys}, NoData, "index.html").SetRegistry(r1)
+	first := NewTemplate(base, "index.html", NoData)
+	second := NewTemplate(base.Copy().SetRegistry(r2), "index.html", NoData)
+
+	for _, r := range []*Registry{r1, r2} {
+		err := r.LoadTemplates()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for templ, want := range map[*core.Templ[int, int]]string{first: "r1", second: "r2"} {
+		b := bytes.NewBufferString("")
+		templ.Render(b, NoData)
+		if b.String() != want {
+			t.Errorf("want: %s\ngot: %s\n", want, b.String())
+		}
+	}
+}
+
+// Validates that all failing templates are reported in the order
+// they were created
+func TestLoadTemplatesJoinsErrors(t *testing.T) {
+	var (
+		caseFS = os.DirFS(case1Dir)
+	)
+
+	defer registry.Reset()
+	b := NewTemplateContext(BaseConfig{FS: caseFS}, case1BaseData{}, "input.html")
+
+	_ = NewTemplate(b.WT("input.partial2.html"), "partial", case1Partial1{})
+	_ = NewTemplate(b.WT("input.partial1.html"), "partial", case1Partial1{})
+	_ = NewTemplate(b.WT("missing.html"), "partial", case1Partial1{})
+	_ = NewTemplate(b.WT("input.partial1.html"), "partial", case1Partial2{})
+
+	err := LoadTemplates()
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("want joined errors\ngot: %v\n", err)
+	}
+
+	errs := joined.Unwrap()
+	want := []struct {
+		with string
+		err  error
+	}{
+		{"input.partial2.html", core.ErrInvalidTemplateData},
+		{"missing.html", core.ErrTemplateParse},
+		{"input.partial1.html", core.ErrInvalidTemplateData},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("want %d errors\ngot: %s\n", len(want), err)
+	}
+
+	for i, w := range want {
+		var loadingErr *core.LoadingError
+		if !errors.As(errs[i], &loadingErr) {
+			t.Fatalf("want *core.LoadingError\ngot: %s\n", errs[i])
+		}
+		if loadingErr.WithTemplates[0] != w.with || !errors.Is(errs[i], w.err) {
+			t.Errorf("error %d\nwant: %s with %s\ngot: %s\n", i, w.with, w.err, errs[i])
+		}
+	}
+}
+
+// Counts how many times each file has been read
+type countingFS struct {
+	fs.FS
+	mu    sync.Mutex
+	reads map[string]int
+}
+
+func newCountingFS(fsys fs.FS) *countingFS {
+	return &countingFS{FS: fsys, reads: make(map[string]int)}
+}
+
+func (c *countingFS) ReadFile(name string) ([]byte, error) {
+	c.mu.Lock()
+	c.reads[name]++
+	c.mu.Unlock()
+	return fs.ReadFile(c.FS, name)
+}
+
+func (c *countingFS) Reads(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reads[name]
+}
+
+// Validates that templates are loaded concurrently and that templates
+// of the same TemplateContext only parse the files once per load
+func TestConcurrentLoadSharesParse(t *testing.T) {
+	var (
+		caseFS = newCountingFS(os.DirFS(case1Dir))
+	)
+
+	defer registry.Reset()
+	defer SetLoadConcurrency(0)
+	SetLoadConcurrency(4)
+
+	b := NewTemplateContext(BaseConfig{FS: caseFS}, case1BaseData{}, "input.html", "input.partial1.html")
+	templs := []*core.Templ[case1BaseData, case1Partial1]{}
+	for i := 0; i < 20; i++ {
+		templs = append(templs, NewTemplate(b, "partial", case1Partial1{}))
+	}
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := caseFS.Reads("input.html"); n != 1 {
+		t.Errorf("want input.html parsed once\ngot: %d\n", n)
+	}
+
+	err = LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := caseFS.Reads("input.html"); n != 2 {
+		t.Errorf("want input.html parsed once per LoadTemplates\ngot: %d\n", n-1)
+	}
+
+	for _, templ := range templs {
+		b := bytes.NewBufferString("")
+		templ.Render(b, case1Partial1{"shared"})
+		if !strings.Contains(b.String(), "<h3>shared</h3>") {
+			t.Errorf("want rendered partial\ngot: %s\n", b.String())
+		}
+	}
+}
+
+// Validates that the base templates are parsed once and shared by the
+// derived TemplateContexts until their base changes
+func TestDerivedContextsShareBaseParse(t *testing.T) {
+	var (
+		caseFS = newCountingFS(os.DirFS(case1Dir))
+	)
+
+	defer registry.Reset()
+	b := NewTemplateContext(BaseConfig{FS: caseFS}, case1BaseData{}, "input.html")
+	p1 := b.WT("input.partial1.html")
+	p2 := b.WT("input.partial2.html")
+
+	_ = NewTemplate(p1, "input.html", case1Partial1{})
+	_ = NewTemplate(p1, "partial", case1Partial1{})
+	_ = NewTemplate(p2, "input.html", case1Partial2{})
+	_ = NewTemplate(p2, "partial", case1Partial2{})
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"input.html", "input.partial1.html", "input.partial2.html"} {
+		if n := caseFS.Reads(file); n != 1 {
+			t.Errorf("want %s parsed once\ngot: %d\n", file, n)
+		}
+	}
+
+	// Changing the funcs detaches p2 from the shared base
+	p2.Funcs(template.FuncMap{"toUpper": strings.ToUpper})
+	err = LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := caseFS.Reads("input.html") - 1; n != 2 {
+		t.Errorf("want input.html parsed twice after Funcs\ngot: %d\n", n)
+	}
+}
+
+// Validates that the onLoad hook runs once per LoadTemplates for a
+// TemplateContext and its copies, and that its base data is used
+func TestOnTemplateLoadRunsOncePerLoad(t *testing.T) {
+	var (
+		caseFS = os.DirFS(case2Dir)
+	)
+
+	type caseData struct {
+		Title int
+	}
+
+	defer registry.Reset()
+	b := NewTemplateContext(BaseConfig{FS: caseFS}, caseData{}, "input.emptydata.html")
+
+	calls := 0
+	b.SetOnTemplateLoadData(func(data caseData) (caseData, error) {
+		calls++
+		data.Title = calls
+		return data, nil
+	})
+
+	templs := []*core.Templ[caseData, int]{}
+	for i := 0; i < 5; i++ {
+		templs = append(templs, NewTemplate(b, "input.emptydata.html", NoData))
+		templs = append(templs, NewTemplate(b.Copy(), "input.emptydata.html", NoData))
+	}
+
+	for i := 1; i <= 2; i++ {
+		err := LoadTemplates()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls != i {
+			t.Errorf("want onLoad called %d times\ngot: %d\n", i, calls)
+		}
+
+		for _, templ := range templs {
+			b := bytes.NewBufferString("")
+			templ.Render(b, NoData)
+			if b.String() != strconv.Itoa(i) {
+				t.Errorf("want: %d\ngot: %s\n", i, b.String())
+			}
+		}
+	}
+
+	// Setting the hook on a copy leaves the hook of the TemplateContext and the other copies as is
+	errFailed := errors.New("manifest missing")
+	failing := b.Copy()
+	failing.SetOnTemplateLoad(func() error {
+		return errFailed
+	})
+	for i := 0; i < 3; i++ {
+		NewTemplate(failing, "input.emptydata.html", NoData)
+	}
+
+	err := LoadTemplates()
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok || len(joined.Unwrap()) != 3 || !errors.Is(err, errFailed) {
+		t.Errorf("want only the templates of the copy to fail with: %s\ngot: %v\n", errFailed, err)
+	}
+	if calls != 3 {
+		t.Errorf("want onLoad called 3 times\ngot: %d\n", calls)
+	}
+}
+
+// Validates that the base data set while the onLoad hook runs is not overwritten
+func TestOnTemplateLoadKeepsConcurrentBaseData(t *testing.T) {
+	var (
+		caseFS = os.DirFS(case2Dir)
+	)
+
+	type caseData struct {
+		Title int
+	}
+
+	defer registry.Reset()
+
+	for _, tt := range []struct {
+		name string
+		set  func(b *core.TemplateContext[caseData], onLoad func())
+		load func() error
+	}{
+		{"hook", func(b *core.TemplateContext[caseData], onLoad func()) {
+			b.SetOnTemplateLoad(func() error { onLoad(); return nil })
+		}, Reload},
+		{"data hook", func(b *core.TemplateContext[caseData], onLoad func()) {
+			b.SetOnTemplateLoadData(func(data caseData) (caseData, error) {
+				onLoad()
+				data.Title++
+				return data, nil
+			})
+		}, LoadTemplates},
+		{"staged data hook", func(b *core.TemplateContext[caseData], onLoad func()) {
+			b.SetOnTemplateLoadData(func(data caseData) (caseData, error) {
+				onLoad()
+				data.Title++
+				return data, nil
+			})
+		}, Reload},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			registry.Reset()
+			b := NewTemplateContext(BaseConfig{FS: caseFS}, caseData{}, "input.emptydata.html")
+			templ := NewTemplate(b, "input.emptydata.html", NoData)
+
+			running := make(chan struct{})
+			proceed := make(chan struct{})
+			tt.set(b, func() {
+				close(running)
+				<-proceed
+			})
+
+			done := make(chan error)
+			go func() { done <- tt.load() }()
+
+			<-running
+			b.SetBaseData(caseData{Title: 42})
+			close(proceed)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+
+			w := bytes.NewBufferString("")
+			templ.Render(w, NoData)
+			if w.String() != "42" {
+				t.Errorf("want: 42\ngot: %s\n", w.String())
+			}
+		})
+	}
+}
+
+// Validates that base data updates propagate to copies and are
+// safe to make concurrently with rendering
+func TestConcurrentBaseDataUpdates(t *testing.T) {
+	var (
+		caseFS = os.DirFS(case2Dir)
+	)
+
+	type caseData struct {
+		Title int
+	}
+
+	defer registry.Reset()
+	b := NewTemplateContext(BaseConfig{FS: caseFS}, caseData{}, "input.emptydata.html")
+	templ := NewTemplate(b.Copy(), "input.emptydata.html", NoData)
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const updates = 100
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				b.UpdateBaseData(func(data caseData) caseData {
+					data.Title++
+					return data
+				})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				templ.Render(io.Discard, NoData)
+			}
+		}()
+	}
+	wg.Wait()
+
+	wr := bytes.NewBufferString("")
+	templ.Render(wr, NoData)
+	if wr.String() != strconv.Itoa(4*updates) {
+		t.Errorf("want: %d\ngot: %s\n", 4*updates, wr.String())
+	}
+}
+
+// Stress tests creating, loading and rendering templates while toggling
+// live reload, intended to be run with -race
+func TestConcurrentStress(t *testing.T) {
+	var (
+		caseFS = os.DirFS(case1Dir)
+	)
+
+	defer registry.Reset()
+	b := NewTemplateContext(BaseConfig{FS: caseFS}, case1BaseData{}, "input.html")
+	p1 := b.WT("input.partial1.html")
+	templ := NewTemplate(p1, "partial", case1Partial1{})
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const iterations = 50
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				f(i)
+			}
+		}()
+	}
+
+	run(func(i int) {
+		_ = NewTemplate(b.WT("input.partial2.html"), "partial", case1Partial2{})
+	})
+	run(func(i int) {
+		if err := LoadTemplates(); err != nil {
+			t.Error(err)
+		}
+	})
+	run(func(i int) {
+		registry.SetLiveReload(i%2 == 0)
+		registry.SetJSToInject([]byte(strconv.Itoa(i)))
+		_ = registry.JSToInject()
+	})
+	for i := 0; i < 4; i++ {
+		run(func(i int) {
+			wr := bytes.NewBufferString("")
+			if err := templ.RenderE(wr, case1Partial1{"stress"}); err != nil {
+				t.Error(err)
+			}
+			if !strings.Contains(wr.String(), "<h3>stress</h3>") {
+				t.Errorf("want rendered partial\ngot: %s\n", wr.String())
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// Validates that renders use the last loaded template until the
+// templates are reloaded, and that failed reloads keep the previous template
+func TestReloadSwapsTemplates(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) {
+		err := os.WriteFile(dir+"/index.html", []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	render := func(templ *core.Templ[int, int]) string {
+		b := bytes.NewBufferString("")
+		templ.Render(b, NoData)
+		return b.String()
+	}
+
+	defer registry.Reset()
+	write("first")
+	base := NewTemplateContext(BaseConfig{FS: os.DirFS(dir)}, NoData, "index.html")
+	index := NewTemplate(base, "index.html", NoData)
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry.SetLiveReload(true)
+	write("second")
+	if got := render(index); got != "first" {
+		t.Errorf("want render to not reparse\nwant: first\ngot: %s\n", got)
+	}
+
+	err = registry.LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := render(index); got != "second" {
+		t.Errorf("want: second\ngot: %s\n", got)
+	}
+
+	write("{{.D.Missing}}")
+	err = registry.LoadTemplates()
+	if err == nil {
+		t.Fatal("want error, .D.Missing does not exist")
+	}
+	if got := render(index); !strings.Contains(got, "Template failed to load") {
+		t.Errorf("want error page while live reloading\ngot: %s\n", got)
+	}
+
+	registry.SetLiveReload(false)
+	if got := render(index); got != "second" {
+		t.Errorf("want previous template kept\nwant: second\ngot: %s\n", got)
+	}
+}
+
+// Validates that calling Load directly parses the files and runs the onLoad hook again
+func TestDirectLoadStartsNewCycle(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) {
+		err := os.WriteFile(dir+"/index.html", []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer registry.Reset()
+	write("first {{.B}}")
+	base := NewTemplateContext(BaseConfig{FS: os.DirFS(dir)}, 0, "index.html")
+	base.SetOnTemplateLoadData(func(data int) (int, error) {
+		return data + 1, nil
+	})
+	index := NewTemplate(base, "index.html", NoData)
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("second {{.B}}")
+	err = index.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := bytes.NewBufferString("")
+	index.Render(b, NoData)
+	if b.String() != "second 2" {
+		t.Errorf("want: second 2\ngot: %s\n", b.String())
+	}
+}
+
+// Validates that only the templates depending on a changed file are reloaded
+func TestLoadChangedReloadsDependents(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		err := os.WriteFile(dir+"/"+name, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	render := func(templ *core.Templ[int, int]) string {
+		b := bytes.NewBufferString("")
+		templ.Render(b, NoData)
+		return b.String()
+	}
+
+	defer registry.Reset()
+	write("index.html", `{{template "nav"}}`)
+	write("global_components.html", `{{define "nav"}}nav1{{end}}`)
+	write("about.html", "about1")
+
+	config := BaseConfig{FS: os.DirFS(dir)}
+	index := NewTemplate(NewTemplateContext(config, NoData, "index.html", "global_components.html"), "index.html", NoData)
+	about := NewTemplate(NewTemplateContext(config, NoData, "about.html"), "about.html", NoData)
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("global_components.html", `{{define "nav"}}nav2{{end}}`)
+	write("about.html", "about2")
+
+	err = registry.LoadChanged([]string{dir + "/global_components.html", dir + "/styles.css"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := render(index); got != "nav2" {
+		t.Errorf("want: nav2\ngot: %s\n", got)
+	}
+	if got := render(about); got != "about1" {
+		t.Errorf("want about.html not reloaded\nwant: about1\ngot: %s\n", got)
+	}
+}
+
+// Validates that a changed file only reloads the templates read from its directory
+func TestLoadChangedResolvesDirs(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	write := func(dir, content string) {
+		err := os.WriteFile(dir+"/index.html", []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer registry.Reset()
+	for _, dir := range dirs {
+		write(dir, "first")
+	}
+
+	templs := []*core.Templ[int, int]{
+		NewTemplate(NewTemplateContext(BaseConfig{FS: os.DirFS(dirs[0])}, NoData, "index.html"), "index.html", NoData),
+		NewTemplate(NewTemplateContext(BaseConfig{FS: os.DirFS(dirs[1])}, NoData, "index.html"), "index.html", NoData),
+		NewTemplate(NewTemplateContext(BaseConfig{FS: fstest.MapFS{"index.html": {Data: []byte("first")}}, SourceDir: dirs[2]}, NoData, "index.html"), "index.html", NoData),
+	}
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, templ := range templs {
+		want := i == 1
+		if got := templ.DependsOn(filepath.Join(dirs[1], "index.html")); got != want {
+			t.Errorf("template %d\nwant depends on %s/index.html: %t\ngot: %t\n", i, dirs[1], want, got)
+		}
+	}
+	if !templs[2].DependsOn(filepath.Join(dirs[2], "index.html")) {
+		t.Errorf("want template depending on its SourceDir")
+	}
+}
+
+// Validates that Reload only swaps in the templates if all of them validate
+func TestReloadIsAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		err := os.WriteFile(dir+"/"+name, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	render := func(templ *core.Templ[int, int]) string {
+		b := bytes.NewBufferString("")
+		templ.Render(b, NoData)
+		return b.String()
+	}
+	reload := func() *http.Response {
+		w := httptest.NewRecorder()
+		ReloadHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/reload", nil))
+		return w.Result()
+	}
+
+	defer registry.Reset()
+	write("a.html", "a1")
+	write("b.html", "b1")
+
+	config := BaseConfig{FS: os.DirFS(dir)}
+	a := NewTemplate(NewTemplateContext(config, NoData, "a.html"), "a.html", NoData)
+	b := NewTemplate(NewTemplateContext(config, NoData, "b.html"), "b.html", NoData)
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("a.html", "a2")
+	write("b.html", "{{.D.Missing}}")
+	if res := reload(); res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("want status: %d\ngot: %d\n", http.StatusInternalServerError, res.StatusCode)
+	}
+	if got := render(a) + render(b); got != "a1b1" {
+		t.Errorf("want previous templates kept\nwant: a1b1\ngot: %s\n", got)
+	}
+
+	write("b.html", "b2")
+	if res := reload(); res.StatusCode != http.StatusNoContent {
+		t.Errorf("want status: %d\ngot: %d\n", http.StatusNoContent, res.StatusCode)
+	}
+	if got := render(a) + render(b); got != "a2b2" {
+		t.Errorf("want: a2b2\ngot: %s\n", got)
+	}
+
+	w := httptest.NewRecorder()
+	ReloadHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/reload", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("want status: %d\ngot: %d\n", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+// Validates that closing the live reload disconnects the clients,
+// waits for them and allows live reload to be started again
+func TestLiveReloaderCloseAndRestart(t *testing.T) {
+	opts := LiveReloadOptions{HandlePattern: "/live-reload", OnReload: HandleReload, PathsToWatch: []string{"testdata"}}
+
+	lr := NewLiveReloader(opts)
+	err := lr.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(lr)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if e := readEvent(t, bufio.NewReader(res.Body)); e.event != "connected" {
+		t.Fatalf("want connected client\ngot: %+v\n", e)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = lr.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadAll(res.Body); err != nil {
+		t.Errorf("want client disconnected\ngot: %s\n", err)
+	}
+	if registry.LiveReload() {
+		t.Error("want live reload disabled after Close")
+	}
+
+	lr = NewLiveReloader(opts)
+	err = lr.Start()
+	if err != nil {
+		t.Fatalf("want live reload to restart\ngot: %s\n", err)
+	}
+	err = lr.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type sseEvent struct {
+	id, event, data string
+}
+
+// Reads the next Server-Sent Event, skipping comments and retry hints
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("want event\ngot: %s\n", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && e.event != "" {
+			return e
+		}
+
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "id":
+			e.id = value
+		case "event":
+			e.event = value
+		case "data":
+			e.data = value
+		}
+	}
+}
+
+// Validates that stylesheet changes are sent as css events
+// and other changes as reloads
+func TestLiveReloadCSSEvent(t *testing.T) {
+	dir := t.TempDir()
+
+	lr := NewLiveReloader(LiveReloadOptions{HandlePattern: "/live-reload", OnReload: func(fsnotify.Event, error) {}, PathsToWatch: []string{dir}})
+	err := lr.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lr.Close(context.Background())
+
+	if !strings.Contains(registry.JSToInject(), `new URL("/live-reload", window.location.href)`) {
+		t.Errorf("want injected JS connecting to the handle pattern\ngot: %s\n", registry.JSToInject())
+	}
+
+	srv := httptest.NewServer(lr)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	r := bufio.NewReader(res.Body)
+	readEvent(t, r) // connected
+
+	err = os.WriteFile(dir+"/styles.css", []byte("body {}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sseEvent{event: "css", data: fmt.Sprintf(`{"paths":[%q]}`, filepath.ToSlash(dir)+"/styles.css")}
+	if got := readEvent(t, r); got.event != want.event || got.data != want.data {
+		t.Errorf("want: %+v\ngot: %+v\n", want, got)
+	}
+
+	err = os.WriteFile(dir+"/index.html", []byte("index"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readEvent(t, r); got.event != "reload" {
+		t.Errorf("want reload event\ngot: %+v\n", got)
+	}
+}
+
+// Validates that reconnecting clients are sent the events they missed
+// and a reload if the events are not from this LiveReloader
+func TestLiveReloadResume(t *testing.T) {
+	dir := t.TempDir()
+
+	lr := NewLiveReloader(LiveReloadOptions{HandlePattern: "/live-reload", OnReload: func(fsnotify.Event, error) {}, PathsToWatch: []string{dir}, Heartbeat: 10 * time.Millisecond})
+	err := lr.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lr.Close(context.Background())
+
+	// Closed after the clients in the cleanups below
+	srv := httptest.NewServer(lr)
+	t.Cleanup(srv.Close)
+
+	connect := func(lastEventID string) *bufio.Reader {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return bufio.NewReader(res.Body)
+	}
+
+	connected := readEvent(t, connect(""))
+
+	err = os.WriteFile(dir+"/styles.css", []byte("body {}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := connect(connected.id)
+	readEvent(t, r) // connected
+	if got := readEvent(t, r); got.event != "css" {
+		t.Errorf("want missed css event\ngot: %+v\n", got)
+	}
+
+	// Heartbeats are comments, the next line read must be one
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, ":") {
+		t.Errorf("want heartbeat comment\ngot: %q %v\n", line, err)
+	}
+
+	r = connect("previous-instance-3")
+	readEvent(t, r) // connected
+	if got := readEvent(t, r); got.event != "reload" {
+		t.Errorf("want reload for a foreign event id\ngot: %+v\n", got)
+	}
+}
+
+// Validates that ignored files and directories do not trigger reloads
+func TestLiveReloadFilters(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"node_modules", "build", "pages"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("# dependencies\nnode_modules/\n*.tmp\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lr := NewLiveReloader(LiveReloadOptions{
+		HandlePattern: "/live-reload",
+		OnReload:      func(fsnotify.Event, error) {},
+		PathsToWatch:  []string{dir},
+		Exclude:       []string{"/build"},
+		IgnoreFiles:   []string{filepath.Join(dir, ".gitignore")},
+		Extensions:    map[string]LiveReloadAction{".scss": LiveReloadActionIgnore},
+	})
+	err = lr.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lr.Close(context.Background())
+
+	srv := httptest.NewServer(lr)
+	t.Cleanup(srv.Close)
+
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+
+	r := bufio.NewReader(res.Body)
+	readEvent(t, r) // connected
+
+	for _, name := range []string{"node_modules/lib.js", "build/index.html", "pages/draft.tmp", "styles.scss", ".index.html.swp", "main.go", "pages/index.html"} {
+		err = os.WriteFile(filepath.Join(dir, name), []byte("changed"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := fmt.Sprintf(`{"paths":[%q]}`, filepath.ToSlash(dir)+"/pages/index.html")
+	if got := readEvent(t, r); got.event != "reload" || got.data != want {
+		t.Errorf("want reload of pages/index.html only\ngot: %+v\n", got)
+	}
+}
+
+// A LiveReloadWatcher driven by the test
+type fakeWatcher struct {
+	mu     sync.Mutex
+	dirs   []string
+	events chan fsnotify.Event
+	errors chan error
+	closed chan struct{}
+}
+
+func newFakeWatcher() *fakeWatcher {
+	return &fakeWatcher{events: make(chan fsnotify.Event), errors: make(chan error), closed: make(chan struct{})}
+}
+
+func (w *fakeWatcher) Add(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.dirs = append(w.dirs, dir)
+	return nil
+}
+
+func (w *fakeWatcher) Events() <-chan fsnotify.Event { return w.events }
+func (w *fakeWatcher) Errors() <-chan error          { return w.errors }
+func (w *fakeWatcher) Close() error                  { close(w.closed); return nil }
+
+// Validates that the LiveReloader can be driven by any LiveReloadWatcher
+func TestLiveReloadCustomWatcher(t *testing.T) {
+	dir := t.TempDir()
+	watcher := newFakeWatcher()
+
+	lr := NewLiveReloader(LiveReloadOptions{HandlePattern: "/live-reload", OnReload: func(fsnotify.Event, error) {}, PathsToWatch: []string{dir}, Watcher: watcher})
+	err := lr.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(lr)
+	t.Cleanup(srv.Close)
+
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+
+	r := bufio.NewReader(res.Body)
+	readEvent(t, r) // connected
+
+	watcher.mu.Lock()
+	if len(watcher.dirs) != 1 || watcher.dirs[0] != dir {
+		t.Errorf("want %s added\ngot: %v\n", dir, watcher.dirs)
+	}
+	watcher.mu.Unlock()
+
+	watcher.events <- fsnotify.Event{Name: filepath.Join(dir, "index.html"), Op: fsnotify.Write}
+	if got := readEvent(t, r); got.event != "reload" {
+		t.Errorf("want reload event\ngot: %+v\n", got)
+	}
+
+	watcher.errors <- errors.New("watch failed")
+	if got := readEvent(t, r); got.event != "error" || got.data != `{"error":"watch failed"}` {
+		t.Errorf("want error event\ngot: %+v\n", got)
+	}
+
+	err = lr.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-watcher.closed:
+	default:
+		t.Error("want watcher closed with the LiveReloader")
+	}
+}
+
+// Validates that only the registries attached to the LiveReloader are reloaded
+func TestLiveReloadRegistries(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) {
+		err := os.WriteFile(dir+"/index.html", []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attached := NewRegistry()
+	detached := NewRegistry()
+	t.Cleanup(attached.Reset)
+	t.Cleanup(detached.Reset)
+
+	write("first")
+	base := NewTemplateContext(BaseConfig{FS: os.DirFS(dir)}, NoData, "index.html")
+	reloaded := NewTemplate(base.Copy().SetRegistry(attached), "index.html", NoData)
+	kept := NewTemplate(base.Copy().SetRegistry(detached), "index.html", NoData)
+	for _, r := range []*Registry{attached, detached} {
+		err := r.LoadTemplates()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	watcher := newFakeWatcher()
+	lr := NewLiveReloader(LiveReloadOptions{HandlePattern: "/live-reload", OnReload: func(fsnotify.Event, error) {}, PathsToWatch: []string{dir}, Watcher: watcher, Registries: []*Registry{attached}})
+	err := lr.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(lr)
+	t.Cleanup(srv.Close)
+
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+
+	r := bufio.NewReader(res.Body)
+	readEvent(t, r) // connected
+
+	write("second")
+	watcher.events <- fsnotify.Event{Name: filepath.Join(dir, "index.html"), Op: fsnotify.Write}
+	readEvent(t, r) // reload
+
+	err = lr.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for templ, want := range map[*core.Templ[int, int]]string{reloaded: "second", kept: "first"} {
+		b := bytes.NewBufferString("")
+		templ.Render(b, NoData)
+		if b.String() != want {
+			t.Errorf("want: %s\ngot: %s\n", want, b.String())
+		}
+	}
+}
+
+// Validates that the polling watcher detects created, written and removed files
+func TestPollingWatcher(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "index.html")
+	err := os.WriteFile(name, []byte("index"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hashing detects the change even though the size is the same
+	w := livereload.NewPollingWatcher(5*time.Millisecond, livereload.CompareHash)
+	defer w.Close()
+
+	err = w.Add(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() fsnotify.Event {
+		t.Helper()
+		select {
+		case e := <-w.Events():
+			return e
+		case err := <-w.Errors():
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("want event")
+		}
+		return fsnotify.Event{}
+	}
+
+	err = os.WriteFile(name, []byte("INDEX"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Name != name || !e.Has(fsnotify.Write) {
+		t.Errorf("want write of %s\ngot: %s\n", name, e)
+	}
+
+	err = os.Mkdir(filepath.Join(dir, "pages"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Name != filepath.Join(dir, "pages") || !e.Has(fsnotify.Create) {
+		t.Errorf("want create of pages\ngot: %s\n", e)
+	}
+
+	err = os.Remove(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Name != name || !e.Has(fsnotify.Remove) {
+		t.Errorf("want remove of %s\ngot: %s\n", name, e)
+	}
+}
+
+// Reads a single unmasked server frame
+func readFrame(t *testing.T, r *bufio.Reader) (opcode byte, payload []byte) {
+	t.Helper()
+
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatalf("want frame\ngot: %s\n", err)
+	}
+
+	n := int(header[1] & 0x7F)
+	if n == 126 {
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		n = int(ext[0])<<8 | int(ext[1])
+	}
+
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("want payload\ngot: %s\n", err)
+	}
+	return header[0] & 0x0F, payload
+}
+
+// Validates the WebSocket handshake, the events sent as messages and the closing handshake
+func TestLiveReloadWebSocket(t *testing.T) {
+	dir := t.TempDir()
+	watcher := newFakeWatcher()
+
+	lr := NewLiveReloader(LiveReloadOptions{HandlePattern: "/live-reload", OnReload: func(fsnotify.Event, error) {}, PathsToWatch: []string{dir}, Watcher: watcher, WebSocket: true})
+	err := lr.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lr.Close(context.Background())
+
+	if !strings.Contains(registry.JSToInject(), "const useWebSocket = true") {
+		t.Errorf("want injected JS using the WebSocket\ngot: %s\n", registry.JSToInject())
+	}
+
+	srv := httptest.NewServer(lr)
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// The example handshake of RFC 6455
+	fmt.Fprint(conn, "GET /live-reload HTTP/1.1\r\nHost: localhost\r\nOrigin: http://localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("want switching protocols\ngot: %s %v\n", res.Status, res.Header)
+	}
+
+	if opcode, payload := readFrame(t, r); opcode != 0x1 || !strings.Contains(string(payload), `"type":"connected"`) {
+		t.Errorf("want connected message\ngot: %d %s\n", opcode, payload)
+	}
+
+	watcher.events <- fsnotify.Event{Name: filepath.Join(dir, "index.html"), Op: fsnotify.Write}
+	want := fmt.Sprintf(`"type":"reload","paths":[%q]}`, filepath.ToSlash(dir)+"/index.html")
+	if opcode, payload := readFrame(t, r); opcode != 0x1 || !strings.Contains(string(payload), want) {
+		t.Errorf("want reload message\ngot: %d %s\n", opcode, payload)
+	}
+
+	// A masked close frame with the status 1000
+	conn.Write([]byte{0x88, 0x82, 1, 2, 3, 4, 0x03 ^ 1, 0xE8 ^ 2})
+	if opcode, payload := readFrame(t, r); opcode != 0x8 || string(payload) != "\x03\xE8" {
+		t.Errorf("want close echoed\ngot: %d %v\n", opcode, payload)
+	}
+}
+
+// Validates that the middleware only injects the live reload client in to HTML responses
+func TestLiveReloadMiddleware(t *testing.T) {
+	defer registry.Reset()
+	registry.SetLiveReload(true)
+	registry.SetJSToInject([]byte("<script>live</script>"))
+
+	gzipped := func(s string) string {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write([]byte(s))
+		zw.Close()
+		return b.String()
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        string
+		want        string
+		status      int // 200 if not set
+	}{
+		{"body", "text/html; charset=utf-8", "", "<html><BODY>page</BODY></html>", "<html><BODY>page<script>live</script></BODY></html>", 0},
+		{"no body tag", "text/html", "", "<p>fragment</p>", "<p>fragment</p><script>live</script>", 0},
+		{"sniffed", "", "", "<!DOCTYPE html><body></body>", "<!DOCTYPE html><body><script>live</script></body>", 0},
+		{"already injected", "text/html", "", "<body><script>live</script></body>", "<body><script>live</script></body>", 0},
+		{"gzip", "text/html", "gzip", gzipped("<body></body>"), "<body><script>live</script></body>", 0},
+		{"not html", "application/json", "", `{"body":"</body>"}`, `{"body":"</body>"}`, 0},
+		{name: "sniffed error page", body: "<html><body>not found</body></html>", want: "<html><body>not found<script>live</script></body></html>", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := LiveReloadMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(tt.body)))
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				io.WriteString(w, tt.body)
+			}))
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if tt.status != 0 && rec.Code != tt.status {
+				t.Errorf("want status %d\ngot: %d\n", tt.status, rec.Code)
+			}
+
+			if rec.Header().Get("Content-Length") != strconv.Itoa(rec.Body.Len()) {
+				t.Errorf("want Content-Length %d\ngot: %s\n", rec.Body.Len(), rec.Header().Get("Content-Length"))
+			}
+
+			got := rec.Body.String()
+			if tt.encoding == "gzip" {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, _ := io.ReadAll(zr)
+				got = string(b)
+			}
+			if got != tt.want {
+				t.Errorf("want: %s\ngot: %s\n", tt.want, got)
+			}
+		})
+	}
+}
+
+// Validates that the templates are read from the SourceDir while live reloading
+// and that it has to contain the same template files as the FS
+func TestSourceDir(t *testing.T) {
+	defer registry.Reset()
+
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<p>source {{.D}}</p>"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prodFS := fstest.MapFS{"index.html": {Data: []byte("<p>prod {{.D}}</p>")}}
+
+	tc := NewTemplateContext(BaseConfig{FS: prodFS, SourceDir: dir}, NoData, "index.html")
+	templ := NewTemplate(tc, "index.html", "data")
+
+	if dirs := registry.SourceDirs(); len(dirs) != 1 || dirs[0] != dir {
+		t.Errorf("want %s to be watched\ngot: %v\n", dir, dirs)
+	}
+
+	render := func() string {
+		t.Helper()
+		err := LoadTemplates()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		templ.Render(&b, "data")
+		return b.String()
+	}
+
+	if got := render(); got != "<p>prod data</p>" {
+		t.Errorf("want the FS in production\ngot: %s\n", got)
+	}
+
+	registry.SetLiveReload(true)
+	if got := render(); got != "<p>source data</p>" {
+		t.Errorf("want the SourceDir while live reloading\ngot: %s\n", got)
+	}
+
+	// A template which has not been embedded
+	err = os.WriteFile(filepath.Join(dir, "new.html"), []byte("new"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := NewTemplateContext(BaseConfig{FS: prodFS, SourceDir: dir}, NoData, "*.html")
+	NewTemplate(all, "index.html", "data")
+
+	err = LoadTemplates()
+	if !errors.Is(err, core.ErrSourceMismatch) || !strings.Contains(err.Error(), "missing in the FS: new.html") {
+		t.Errorf("want source mismatch of new.html\ngot: %v\n", err)
+	}
+}
+
+// Validates that the templates loaded before the LiveReloader starts
+// are read from the SourceDir and checked against the FS once it has
+func TestLiveReloadStartUsesSourceDir(t *testing.T) {
+	defer registry.Reset()
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{"index.html": "disk", "new.html": "new"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	prodFS := fstest.MapFS{"index.html": {Data: []byte("embed")}}
+
+	index := NewTemplate(NewTemplateContext(BaseConfig{FS: prodFS, SourceDir: dir}, NoData, "index.html"), "index.html", NoData)
+	NewTemplate(NewTemplateContext(BaseConfig{FS: prodFS, SourceDir: dir}, NoData, "*.html"), "index.html", NoData)
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reloadErr error
+	lr := NewLiveReloader(LiveReloadOptions{HandlePattern: "/live-reload", OnReload: func(_ fsnotify.Event, err error) { reloadErr = err }, Watcher: newFakeWatcher()})
+	err = lr.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lr.Close(context.Background())
+
+	var b strings.Builder
+	index.Render(&b, NoData)
+	if b.String() != "disk" {
+		t.Errorf("want the SourceDir once started\ngot: %s\n", b.String())
+	}
+	if !errors.Is(reloadErr, core.ErrSourceMismatch) {
+		t.Errorf("want source mismatch passed to OnReload\ngot: %v\n", reloadErr)
+	}
+}
+
+// Validates that layered FSes override whole files, or only define blocks when merged
+func TestLayers(t *testing.T) {
+	defer registry.Reset()
+
+	baseFS := fstest.MapFS{
+		"index.html":      {Data: []byte(`<nav>{{template "nav"}}</nav>{{template "footer"}}`)},
+		"components.html": {Data: []byte(`{{define "nav"}}base nav{{end}}{{define "footer"}}base footer{{end}}`)},
+	}
+
+	base := NewTemplateContext(BaseConfig{FS: baseFS}, NoData, "index.html", "*.html")
+	page := NewTemplate(base, "index.html", NoData)
+	overridden := NewTemplate(base.WithLayer(fstest.MapFS{
+		"index.html": {Data: []byte(`<h1>{{template "nav"}}</h1>`)},
+	}), "index.html", NoData)
+
+	merged := NewTemplateContext(BaseConfig{FS: baseFS, MergeDefines: true}, NoData, "index.html", "components.html")
+	tenant := NewTemplate(merged.WithLayer(fstest.MapFS{
+		"components.html": {Data: []byte(`{{define "nav"}}tenant nav{{end}}`)},
+	}), "index.html", NoData)
+
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		templ *core.Templ[int, int]
+		want  string
+	}{
+		{page, "<nav>base nav</nav>base footer"},
+		{overridden, "<h1>base nav</h1>"},
+		{tenant, "<nav>tenant nav</nav>base footer"},
+	} {
+		var b strings.Builder
+		tt.templ.Render(&b, NoData)
+		if b.String() != tt.want {
+			t.Errorf("want: %s\ngot: %s\n", tt.want, b.String())
+		}
+	}
+}
+
+// Validates that funcs are merged across the registry and derived contexts
+// and that redefining a func requires an override
+func TestFuncComposition(t *testing.T) {
+	r := NewRegistry()
+	t.Cleanup(r.Reset)
+	r.Funcs(template.FuncMap{"upper": strings.ToUpper})
+
+	fsys := fstest.MapFS{
+		"index.html": {Data: []byte(`{{upper .D}} {{greet}}`)},
+		"shout.html": {Data: []byte(`{{shout .D}}`)},
+	}
+
+	// Closures of the same function literal are different funcs
+	greeter := func(greeting string) func() string {
+		return func() string { return greeting }
+	}
+
+	base := NewTemplateContext(BaseConfig{FS: fsys}, NoData, "index.html").SetRegistry(r).Funcs(template.FuncMap{"greet": greeter("hi")})
+	// Adding the same top level func again is not a conflict
+	derived := base.WithTemplates("shout.html").Funcs(template.FuncMap{"shout": func(s string) string { return s + "!" }, "upper": strings.ToUpper})
+	conflicting := base.Copy().Funcs(template.FuncMap{"upper": strings.ToLower, "greet": greeter("hej")})
+	overridden := base.Copy().OverrideFuncs(template.FuncMap{"upper": strings.ToLower})
+
+	index := NewTemplate(base, "index.html", "loadr")
+	shout := NewTemplate(derived, "shout.html", "loadr")
+	NewTemplate(conflicting, "index.html", "loadr")
+	lower := NewTemplate(overridden, "index.html", "LOADR")
+
+	err := r.LoadTemplates()
+	if !errors.Is(err, core.ErrFuncConflict) || !strings.Contains(err.Error(), ": upper") || !strings.Contains(err.Error(), ": greet") {
+		t.Errorf("want conflicts of upper and greet\ngot: %v\n", err)
+	}
+	if strings.Count(err.Error(), "basetemplates") != 1 {
+		t.Errorf("want only the conflicting context to fail\ngot: %v\n", err)
+	}
+
+	for _, tt := range []struct {
+		render func(w io.Writer) error
+		want   string
+	}{
+		{func(w io.Writer) error { return index.RenderE(w, "loadr") }, "LOADR hi"},
+		{func(w io.Writer) error { return shout.RenderE(w, "loadr") }, "loadr!"},
+		{func(w io.Writer) error { return lower.RenderE(w, "LOADR") }, "loadr hi"},
+	} {
+		var b strings.Builder
+		err := tt.render(&b)
+		if err != nil || b.String() != tt.want {
+			t.Errorf("want: %s\ngot: %s %v\n", tt.want, b.String(), err)
+		}
+	}
+}
+
+// Validates that WebSocket handshakes from other origins are rejected unless allowed
+func TestLiveReloadWebSocketOrigin(t *testing.T) {
+	// Not started, so the allowed handshakes fail as unavailable instead
+	lr := NewLiveReloader(LiveReloadOptions{HandlePattern: "/live-reload", AllowedOrigins: []string{"http://localhost:5173"}})
+
+	for origin, want := range map[string]int{
+		"":                      http.StatusServiceUnavailable,
+		"http://localhost:8080": http.StatusServiceUnavailable,
+		"http://localhost:5173": http.StatusServiceUnavailable,
+		"http://localhost:3000": http.StatusForbidden,
+		"https://evil.example":  http.StatusForbidden,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost:8080/live-reload", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+
+		w := httptest.NewRecorder()
+		lr.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("origin %q\nwant: %d\ngot: %d\n", origin, want, w.Code)
+		}
+	}
+}
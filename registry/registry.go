@@ -1,71 +1,366 @@
 package registry
 
 import (
+	"errors"
+	"maps"
+	"runtime"
 	"sync"
+	"sync/atomic"
 )
 
 type Loader interface {
 	Load() error
 }
 
-type registry struct {
-	loaders    map[Loader]struct{}
-	liveReload bool   // If true, sets the Templ to reload on every Render() call
-	jsToInject string // JS to inject at the end of the body
+// Implemented by loaders which know the files they are loaded from,
+// allowing only the affected loaders to be reloaded when files change
+type DependencyLoader interface {
+	Loader
+	DependsOn(path string) bool // Reports whether the loader must be reloaded if the file at path changed
 }
 
-var store = registry{loaders: make(map[Loader]struct{})}
+// Implemented by loaders which share work with the other loaders
+// loaded within the same load cycle of the registry
+type CycleLoader interface {
+	Loader
+	LoadCycle(cycle uint64) error // Loads within the cycle, where Load starts a new cycle
+}
+
+// Implemented by loaders which can be loaded and validated without being
+// applied, allowing a Reload to only apply if every loader succeeds
+type StagedLoader interface {
+	Loader
+	Stage(cycle uint64) (commit func(), err error) // Loads and validates within the cycle, commit applies the result
+}
+
+// A set of templates which are loaded and validated together.
+// All methods are safe for concurrent use.
+//
+// Most applications only need the default registry, separate registries are
+// useful for tests running in parallel or modules owning their own templates.
+type Registry struct {
+	mu          sync.Mutex
+	loadMu      sync.Mutex // Serialises the loads, so an older load never overwrites a newer one
+	loaders     []Loader   // In the order they were added
+	added       map[Loader]struct{}
+	concurrency int // Maximum number of templates loaded concurrently, GOMAXPROCS if < 1
+	funcs       []map[string]any
+}
+
+// Creates a new empty registry
+func New() *Registry {
+	return &Registry{added: make(map[Loader]struct{})}
+}
+
+var defaultRegistry = New()
+
+// Returns the default registry used by all TemplateContexts
+// which have not been bound to another registry
+func Default() *Registry {
+	return defaultRegistry
+}
 
-var mu sync.Mutex
+var (
+	liveReload atomic.Bool  // If true, sets the Templ to reload on every Render() call
+	jsToInject atomic.Value // JS to inject at the end of the body, always a string
+
+	sourceDirsMu sync.Mutex
+	sourceDirs   []string // The directories the templates are read from while live reloading
+)
 
 // Adds a BaseRender and it's pattern to the register
-func Add(l Loader) {
-	_, ok := store.loaders[l]
-	mu.Lock()
-	if !ok {
-		store.loaders[l] = struct{}{}
+func (r *Registry) Add(l Loader) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.added[l]; ok {
+		return
 	}
-	mu.Unlock()
+	r.added[l] = struct{}{}
+	r.loaders = append(r.loaders, l)
 }
 
-// Enables or disables live reloading
-func SetLiveReload(enabled bool) {
-	store.liveReload = enabled
+// Sets the maximum number of templates loaded concurrently by LoadTemplates.
+// If n < 1, GOMAXPROCS is used which is also the default.
+func (r *Registry) SetConcurrency(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.concurrency = n
 }
 
-// Checks if live reloading is enabled
-func LiveReload() bool {
-	return store.liveReload
+// Adds funcs available to the templates of every TemplateContext bound to the
+// registry. The funcs must be added before the templates are loaded.
+//
+// A TemplateContext adding a different func of the same name, or adding
+// it again to the registry, fails to load unless it overrides it.
+func (r *Registry) Funcs(funcs map[string]any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.funcs = append(r.funcs, maps.Clone(funcs))
 }
 
-func SetJSToInject(b []byte) {
-	store.jsToInject = string(b)
+// The funcs of every Funcs call in the order they were added,
+// the maps must not be modified
+func (r *Registry) FuncMaps() []map[string]any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]map[string]any(nil), r.funcs...)
 }
 
-func JSToInject() string {
-	return store.jsToInject
+// The last load cycle started by any registry, so the cycles of
+// different registries never collide
+var cycles atomic.Uint64
+
+// Starts a new load cycle, returning it. Loaders loaded within the same
+// cycle share their work, see CycleLoader.
+func (r *Registry) NewCycle() uint64 {
+	return cycles.Add(1)
 }
 
 // Prepares the templates by loading and validating them
-func LoadTemplates() error {
+// concurrently, see SetConcurrency.
+//
+// Every template is loaded, the errors of all failing templates
+// are joined in the order the templates were added.
+func (r *Registry) LoadTemplates() error {
+	r.mu.Lock()
+	loaders := append([]Loader(nil), r.loaders...)
+	r.mu.Unlock()
+
+	return r.load(loaders)
+}
+
+// Reloads only the templates depending on any of the changed file paths,
+// loaders which do not implement DependencyLoader are always reloaded.
+//
+// The errors are joined as in LoadTemplates.
+func (r *Registry) LoadChanged(paths []string) error {
+	r.mu.Lock()
+	loaders := []Loader{}
+	for _, l := range r.loaders {
+		if dependsOn(l, paths) {
+			loaders = append(loaders, l)
+		}
+	}
+	r.mu.Unlock()
 
-	for loader := range store.loaders {
-		err := loader.Load()
-		if err != nil {
-			return err
+	if len(loaders) == 0 {
+		return nil
+	}
+
+	return r.load(loaders)
+}
+
+func dependsOn(l Loader, paths []string) bool {
+	dl, ok := l.(DependencyLoader)
+	if !ok {
+		return true
+	}
+	for _, path := range paths {
+		if dl.DependsOn(path) {
+			return true
 		}
 	}
+	return false
+}
+
+// Loads the loaders concurrently within a new load cycle
+func (r *Registry) load(loaders []Loader) error {
+	r.loadMu.Lock()
+	defer r.loadMu.Unlock()
 
-	return nil
+	return r.loadLocked(loaders)
+}
+
+// The same as load, must be called with loadMu held
+func (r *Registry) loadLocked(loaders []Loader) error {
+	cycle := r.NewCycle()
+
+	errs := r.each(loaders, func(_ int, l Loader) error {
+		if cl, ok := l.(CycleLoader); ok {
+			return cl.LoadCycle(cycle)
+		}
+		return l.Load()
+	})
+	return errors.Join(errs...)
+}
+
+// Reloads every template but only applies the result if all of them
+// load and validate, otherwise the joined errors are returned and the
+// previously loaded templates are kept.
+//
+// Loaders which do not implement StagedLoader are loaded after
+// the others have been applied. LoadTemplates and LoadChanged wait
+// for the Reload to be applied, and the other way around.
+func (r *Registry) Reload() error {
+	// No other load can be applied between the staging and the commits
+	r.loadMu.Lock()
+	defer r.loadMu.Unlock()
+
+	r.mu.Lock()
+	loaders := append([]Loader(nil), r.loaders...)
+	r.mu.Unlock()
+
+	cycle := r.NewCycle()
+
+	commits := make([]func(), len(loaders))
+	errs := r.each(loaders, func(i int, l Loader) error {
+		sl, ok := l.(StagedLoader)
+		if !ok {
+			return nil
+		}
+
+		var err error
+		commits[i], err = sl.Stage(cycle)
+		return err
+	})
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	unstaged := []Loader{}
+	for i, commit := range commits {
+		if commit == nil {
+			unstaged = append(unstaged, loaders[i])
+			continue
+		}
+		commit()
+	}
+
+	return r.loadLocked(unstaged)
+}
+
+// Calls f with the index of every loader concurrently, see SetConcurrency.
+// The errors are returned in the order of the loaders.
+func (r *Registry) each(loaders []Loader, f func(i int, l Loader) error) []error {
+	r.mu.Lock()
+	workers := r.concurrency
+	r.mu.Unlock()
+
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	errs := make([]error, len(loaders))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, loader := range loaders {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, loader Loader) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = f(i, loader)
+		}(i, loader)
+	}
+	wg.Wait()
+
+	return errs
 }
 
 // Should not be used unless you know what you are doing.
 //
-// Resests the store, this is helpful for tests to reset
-// the store if incorrect templates are purposfully provided.
+// Resests the registry, this is helpful for tests to reset
+// the registry if incorrect templates are purposfully provided.
 // WARNING: If Reset() is used directly in application logic
 // this can remove existing templates, allow Load to silently
 // pass and create runtime panics.
+func (r *Registry) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.loaders = nil
+	r.added = make(map[Loader]struct{})
+	r.funcs = nil
+}
+
+// Adds funcs available to the templates of the default registry, see Registry.Funcs
+func Funcs(funcs map[string]any) {
+	defaultRegistry.Funcs(funcs)
+}
+
+// Adds a BaseRender and it's pattern to the default registry
+func Add(l Loader) {
+	defaultRegistry.Add(l)
+}
+
+// Sets the maximum number of templates loaded concurrently
+// by the default registry, see Registry.SetConcurrency
+func SetConcurrency(n int) {
+	defaultRegistry.SetConcurrency(n)
+}
+
+// Enables or disables live reloading, it is safe to toggle
+// concurrently with rendering
+func SetLiveReload(enabled bool) {
+	liveReload.Store(enabled)
+}
+
+// Checks if live reloading is enabled
+func LiveReload() bool {
+	return liveReload.Load()
+}
+
+func SetJSToInject(b []byte) {
+	jsToInject.Store(string(b))
+}
+
+func JSToInject() string {
+	js, _ := jsToInject.Load().(string)
+	return js
+}
+
+// Adds a directory on disk which the templates are read from while
+// live reloading, it is watched by the live reloaders started afterwards
+func AddSourceDir(dir string) {
+	sourceDirsMu.Lock()
+	defer sourceDirsMu.Unlock()
+
+	for _, d := range sourceDirs {
+		if d == dir {
+			return
+		}
+	}
+	sourceDirs = append(sourceDirs, dir)
+}
+
+// The directories added with AddSourceDir
+func SourceDirs() []string {
+	sourceDirsMu.Lock()
+	defer sourceDirsMu.Unlock()
+
+	return append([]string(nil), sourceDirs...)
+}
+
+// Prepares the templates of the default registry by loading and validating them
+func LoadTemplates() error {
+	return defaultRegistry.LoadTemplates()
+}
+
+// Reloads the templates of the default registry depending on the changed
+// file paths, see Registry.LoadChanged
+func LoadChanged(paths []string) error {
+	return defaultRegistry.LoadChanged(paths)
+}
+
+// Reloads the templates of the default registry, see Registry.Reload
+func Reload() error {
+	return defaultRegistry.Reload()
+}
+
+// Resets the default registry as well as the live reload settings,
+// see Registry.Reset
 func Reset() {
-	store = registry{loaders: make(map[Loader]struct{})}
+	defaultRegistry.Reset()
+	SetLiveReload(false)
+	SetJSToInject(nil)
+
+	sourceDirsMu.Lock()
+	sourceDirs = nil
+	sourceDirsMu.Unlock()
 }